@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/response"
+	"openheart.tylery.com/internal/validator"
+	"openheart.tylery.com/internal/version"
+)
+
+const (
+	apiPrefix    = "/api/v1"
+	maxBatchUrls = 50
+)
+
+// Every response under /api/v1 is wrapped in an envelope. Successful responses set data, failed responses
+// set error, never both.
+type envelope struct {
+	Data  any       `json:"data,omitempty"`
+	Error *apiError `json:"error,omitempty"`
+}
+
+func (e envelope) Unwrap() any {
+	return e.Data
+}
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestId string `json:"request_id,omitempty"` // To find the request in the logs, from X-Request-ID
+}
+
+type siteCounts struct {
+	Url    string          `json:"url"`
+	Counts response.Counts `json:"counts"`
+}
+
+func (s siteCounts) Columns() []string {
+	return s.Counts.Columns()
+}
+
+func (s siteCounts) Rows() [][]string {
+	return s.Counts.Rows()
+}
+
+type siteCountsList []siteCounts
+
+func (l siteCountsList) Columns() []string {
+	return []string{"url", "emoji", "count"}
+}
+
+func (l siteCountsList) Rows() [][]string {
+	var rows [][]string
+	for _, s := range l {
+		for _, row := range s.Rows() {
+			rows = append(rows, append([]string{s.Url}, row...))
+		}
+	}
+	return rows
+}
+
+type reaction struct {
+	Url   string `json:"url"`
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+func (app *application) apiRoutes() []route {
+	return []route{
+		{
+			method:   http.MethodGet,
+			path:     "/status",
+			handler:  app.apiStatus,
+			summary:  "Report the server status and version",
+			response: "Status",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/reactions",
+			handler:  app.apiListReactions,
+			summary:  "Get the reaction counts for several URLs at once",
+			query:    []routeParam{{name: "url", description: "A page URL. Repeat for each URL, up to 50.", required: true, repeated: true}},
+			response: "SiteCountsList",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/reactions/{url...}",
+			handler:  app.apiGetReactions,
+			summary:  "Get the reaction counts for a URL",
+			response: "SiteCounts",
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/reactions/{url...}",
+			handler:  app.apiCreateReaction,
+			summary:  "Add a reaction to a URL",
+			request:  "ReactionRequest",
+			response: "Reaction",
+			status:   http.StatusCreated,
+			limited:  true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/stream/{url...}",
+			handler: app.stream,
+			summary: "Stream count updates for a URL as Server-Sent Events",
+			stream:  true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/socket",
+			handler: app.websocket,
+			summary: "Send reactions and receive live counts for many URLs over a WebSocket",
+			socket:  true,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/webhooks",
+			handler:  app.apiCreateWebhook,
+			summary:  "Register a webhook, notified as a URL receives reactions. The secret is only returned here.",
+			request:  "WebhookRequest",
+			response: "Webhook",
+			status:   http.StatusCreated,
+			admin:    true,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/webhooks",
+			handler:  app.apiListWebhooks,
+			summary:  "List the webhooks registered for a URL",
+			query:    []routeParam{{name: "url", description: "The page URL", required: true}},
+			response: "WebhookList",
+			admin:    true,
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/webhooks/{id}",
+			handler:  app.apiDeleteWebhook,
+			summary:  "Delete a webhook, along with any deliveries it has pending",
+			response: "Webhook",
+			admin:    true,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/sites/{url...}",
+			handler:  app.apiGetSite,
+			summary:  "Get the origins allowed to react to a URL from a browser",
+			response: "Site",
+			admin:    true,
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/sites/{url...}",
+			handler:  app.apiUpdateSite,
+			summary:  "Restrict the origins allowed to react to a URL from a browser. No origins allows any.",
+			request:  "SiteRequest",
+			response: "Site",
+			admin:    true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/openapi.json",
+			handler: app.apiOpenAPI,
+			summary: "This OpenAPI document",
+			raw:     true,
+		},
+	}
+}
+
+func (app *application) apiStatus(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"status":  "OK",
+		"version": version.Get(),
+	}
+	if app.countsCache != nil {
+		data["cache"] = app.countsCache.Stats()
+	}
+	app.apiResponse(w, r, http.StatusOK, data, nil)
+}
+
+func (app *application) apiGetReactions(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.PathValue("url")).Parse()
+	if err != nil {
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	counts, modified, err := app.counts(r.Context(), parsedUrl)
+	if errors.Is(err, database.ErrNotFound) {
+		app.apiNotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	data := siteCounts{Url: parsedUrl, Counts: counts}
+
+	renderer, ok := app.apiNegotiate(w, r, data)
+	if !ok {
+		return
+	}
+
+	notModified, err := app.notModified(w, r, renderer, data, modified)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if notModified {
+		return
+	}
+
+	app.apiRender(w, r, renderer, http.StatusOK, data, nil)
+}
+
+func (app *application) apiListReactions(w http.ResponseWriter, r *http.Request) {
+	urls := r.URL.Query()["url"]
+
+	var v validator.Validator
+	v.Check(len(urls) > 0, "at least one url must be provided")
+	v.Check(len(urls) <= maxBatchUrls, fmt.Sprintf("must not contain more than %d urls", maxBatchUrls))
+
+	parsedUrls := make([]string, len(urls))
+	for i := range urls {
+		parsedUrl, err := request.InputUrl(urls[i]).Parse()
+		v.CheckField(err == nil, urls[i], "must contain a hostname")
+		parsedUrls[i] = parsedUrl
+	}
+
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	// The batch is as fresh as its most recently modified site
+	var lastModified time.Time
+
+	data := make(siteCountsList, 0, len(parsedUrls))
+	for _, parsedUrl := range parsedUrls {
+		counts, modified, err := app.counts(r.Context(), parsedUrl)
+		if errors.Is(err, database.ErrNotFound) {
+			counts = map[string]int{}
+		} else if err != nil {
+			app.apiServerError(w, r, err)
+			return
+		}
+		if modified.After(lastModified) {
+			lastModified = modified
+		}
+		data = append(data, siteCounts{Url: parsedUrl, Counts: counts})
+	}
+
+	renderer, ok := app.apiNegotiate(w, r, data)
+	if !ok {
+		return
+	}
+
+	notModified, err := app.notModified(w, r, renderer, data, lastModified)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if notModified {
+		return
+	}
+
+	app.apiRender(w, r, renderer, http.StatusOK, data, nil)
+}
+
+func (app *application) apiCreateReaction(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.PathValue("url")).Parse()
+	if err != nil {
+		app.rejectReaction(errCodeInvalidUrl)
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadByteSize))
+	if err != nil {
+		app.rejectReaction(errCodeBadRequest)
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	emoji, err := request.ParseEmoji(r.Header.Get("Content-Type"), body)
+	switch {
+	case errors.Is(err, request.ErrBadJSON):
+		app.rejectReaction(errCodeBadRequest)
+		app.apiBadRequest(w, r, err)
+		return
+	case err != nil:
+		app.rejectReaction(errCodeInvalidEmoji)
+		app.apiInvalidEmoji(w, r, err)
+		return
+	}
+
+	count, created, err := app.addReaction(r, parsedUrl, emoji)
+	if errors.Is(err, errBlocked) {
+		app.apiForbidden(w, r, "reactions to this site aren't accepted from you")
+		return
+	}
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	app.apiResponse(w, r, status, reaction{Url: parsedUrl, Emoji: emoji.String(), Count: count}, nil)
+}
+
+func (app *application) apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	err := response.JSON(w, http.StatusOK, openAPIDocument(app.apiRoutes()))
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+// apiFallback handles any /api/v1 path that no route matched. If the path exists under another method,
+// we answer 405 with an Allow header, otherwise 404. Both in the API's envelope, unlike the mux's defaults.
+func (app *application) apiFallback(mux *http.ServeMux, routes []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, rt := range routes {
+			if rt.method == r.Method {
+				continue
+			}
+
+			probe := r.Clone(r.Context())
+			probe.Method = rt.method
+			_, pattern := mux.Handler(probe)
+			if pattern == rt.pattern() && validator.NotIn(rt.method, allowed...) {
+				allowed = append(allowed, rt.method)
+			}
+		}
+
+		if len(allowed) > 0 {
+			app.apiMethodNotAllowed(w, r, allowed)
+			return
+		}
+		app.apiNotFound(w, r)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"openheart.tylery.com/internal/badge"
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/response"
+	"openheart.tylery.com/internal/validator"
+)
+
+const (
+	defaultBadgeTop   = 3
+	maxBadgeTop       = 10
+	defaultBadgeLabel = "reactions"
+)
+
+// badge renders the top reactions for a url as an SVG, for READMEs and static sites that can't run JS.
+//
+//	GET /badge/example.com.svg?top=3&theme=dark&emoji=💖,👍&compact=false&label=hearts
+func (app *application) badge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	opts := badge.Options{
+		Label:   query.Get("label"),
+		Theme:   badge.Themes["light"],
+		Compact: query.Get("compact") != "false",
+	}
+	if opts.Label == "" {
+		opts.Label = defaultBadgeLabel
+	}
+	if theme, exists := badge.Themes[query.Get("theme")]; exists {
+		opts.Theme = theme
+	}
+
+	top := defaultBadgeTop
+	if n, err := strconv.Atoi(query.Get("top")); err == nil && validator.Between(n, 1, maxBadgeTop) {
+		top = n
+	}
+
+	var only []string
+	for _, emoji := range strings.Split(query.Get("emoji"), ",") {
+		if emoji = strings.TrimSpace(emoji); emoji != "" {
+			only = append(only, emoji)
+		}
+	}
+
+	urlPathValue := request.InputUrl(strings.TrimSuffix(r.PathValue("url"), ".svg"))
+	parsedUrl, err := urlPathValue.Parse()
+	if err != nil {
+		app.svg(w, r, http.StatusBadRequest, badge.RenderText(opts.Label, "invalid url", opts.Theme))
+		return
+	}
+
+	counts, modified, err := app.counts(r.Context(), parsedUrl)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		if app.isUnavailable(err) {
+			w.Header().Set("Retry-After", retryAfter.Get("Retry-After"))
+			app.svg(w, r, http.StatusServiceUnavailable, badge.RenderText(opts.Label, "unavailable", opts.Theme))
+			return
+		}
+		app.reportServerError(r, err)
+		app.svg(w, r, http.StatusInternalServerError, badge.RenderText(opts.Label, "unavailable", opts.Theme))
+		return
+	}
+
+	if len(only) > 0 {
+		for emoji := range counts {
+			if validator.NotIn(emoji, only...) {
+				delete(counts, emoji)
+			}
+		}
+	}
+
+	content := badge.Render(badge.Top(counts, top), opts)
+
+	etag, err := response.WeakETag(content)
+	if err != nil {
+		app.reportServerError(r, err)
+		app.svg(w, r, http.StatusInternalServerError, badge.RenderText(opts.Label, "unavailable", opts.Theme))
+		return
+	}
+
+	w.Header().Set("Cache-Control", app.cacheControl())
+	if response.NotModified(w, r, etag, modified) {
+		return
+	}
+	app.svg(w, r, http.StatusOK, content)
+}
+
+func (app *application) svg(w http.ResponseWriter, r *http.Request, status int, content []byte) {
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write(content)
+	if err != nil {
+		app.reportServerError(r, err)
+	}
+}
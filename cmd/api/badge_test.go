@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Badges are cached for cache-max-age, as it is after a reload
+func TestBadgeCacheControl(t *testing.T) {
+	app := newDegradedApp()
+	app.countsCache.Load("example.com", func() (cachedCounts, error) {
+		return cachedCounts{counts: map[string]int{"💖": 3}}, nil
+	})
+
+	for _, maxAge := range []time.Duration{time.Minute, 5 * time.Second} {
+		app.settings.Store(&settings{cacheMaxAge: maxAge})
+
+		r := httptest.NewRequest(http.MethodGet, "/badge/example.com.svg", nil)
+		r.SetPathValue("url", "example.com.svg")
+		w := httptest.NewRecorder()
+		app.badge(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if got, want := w.Header().Get("Cache-Control"), app.cacheControl(); got != want {
+			t.Errorf("Cache-Control = %q, want %q", got, want)
+		}
+	}
+}
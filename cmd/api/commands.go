@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"openheart.tylery.com/internal/database"
+)
+
+const programName = "openheart-protocol"
+
+// A command is one of the things the binary does, named by its first argument. Every command takes the
+// settings, so the database and logging are configured the same way for all of them.
+type command struct {
+	name    string
+	args    string // The arguments after the flags, for the usage
+	summary string
+	flags   func(flags *flag.FlagSet, cfg *config) // Flags of its own, besides the settings
+	run     func(app *application) error
+}
+
+var commands []command
+
+// The commands are only listed once the package is initialised, as serving refers back to them on reloads
+func init() {
+	commands = []command{
+		{
+			name:    "serve",
+			summary: "Serve the API, migrating the database first unless -migrate says otherwise. This is the default without a command.",
+			run:     (*application).serve,
+		},
+		{
+			name:    "migrate",
+			args:    "up | down [N] | version | force VERSION",
+			summary: "Migrate the database up to the schema of this build, or down by N migrations (1 by default), print its version, or force the version after fixing a failed migration by hand.",
+			run:     (*application).migrate,
+		},
+		{
+			name:    "export",
+			summary: "Write the counts of every site, and with -reactions every single reaction and daily rollup, as JSON Lines or CSV.",
+			flags: func(flags *flag.FlagSet, cfg *config) {
+				flags.StringVar(&cfg.export.output, "output", "-", "File to write to (- for stdout)")
+				flags.StringVar(&cfg.export.format, "format", formatJSONL, "Format to write: jsonl or csv")
+				flags.BoolVar(&cfg.export.reactions, "reactions", false, "Export every reaction, and the daily rollups of compacted ones, as well as the counts")
+			},
+			run: (*application).export,
+		},
+		{
+			name:    "import",
+			args:    "[FILE]",
+			summary: "Import an export from FILE or stdin, merging its counts into the ones there are. Importing the same file again with the same flags writes nothing.",
+			flags: func(flags *flag.FlagSet, cfg *config) {
+				flags.StringVar(&cfg.importing.format, "format", "", "Format to read: jsonl or csv (by the file's extension when empty)")
+				flags.StringVar(&cfg.importing.merge, "merge", string(database.MergeReplace), "How imported counts are merged: sum adds them, replace overwrites, max keeps the higher")
+				flags.IntVar(&cfg.importing.batchSize, "batch-size", 500, "How many counts and reactions to write in each transaction")
+			},
+			run: (*application).importData,
+		},
+		{
+			name:    "import-counts",
+			args:    "[FILE]",
+			summary: "Import the counts another Open Heart implementation serves, of the url given with -url from FILE, or of every url in -manifest.",
+			flags: func(flags *flag.FlagSet, cfg *config) {
+				flags.StringVar(&cfg.importing.url, "url", "", "Url the counts in FILE are of")
+				flags.StringVar(&cfg.importing.manifest, "manifest", "", "JSON file mapping urls to the files with their counts")
+				flags.StringVar(&cfg.importing.merge, "merge", string(database.MergeReplace), "How imported counts are merged: sum adds them, replace overwrites, max keeps the higher")
+				flags.IntVar(&cfg.importing.batchSize, "batch-size", 500, "How many counts to write in each transaction")
+			},
+			run: (*application).importCounts,
+		},
+		{
+			name:    "prune",
+			summary: "Prune stale sites and compact old reactions once, by the prune settings, and report what was pruned. With -prune-dry-run nothing is changed.",
+			run:     (*application).prune,
+		},
+		{
+			name:    "stats",
+			summary: "Print the sites and emoji with the most reactions.",
+			flags: func(flags *flag.FlagSet, cfg *config) {
+				flags.IntVar(&cfg.stats.limit, "limit", 10, "How many sites and emoji to list")
+			},
+			run: (*application).stats,
+		},
+		{
+			name:    "version",
+			summary: "Print the version.",
+		},
+		{
+			name:    "help",
+			summary: "List the commands. Every command takes -h for its flags.",
+		},
+	}
+}
+
+// splitCommand returns the command the arguments name, and the arguments that follow it
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		return args[1], args[2:]
+	}
+	return "serve", args[1:]
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func (cmd command) usage(flags *flag.FlagSet) {
+	out := flags.Output()
+	fmt.Fprintf(out, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n", programName, cmd.name, cmd.args, cmd.summary)
+	flags.PrintDefaults()
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n", programName)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+}
+
+// migrate is the migrate command, which lets a deploy migrate the database as a step of its own
+func (app *application) migrate() error {
+	ctx := context.Background()
+	args := app.config.args
+	if len(args) == 0 {
+		return fmt.Errorf("migrate needs one of up, down, version or force")
+	}
+
+	err := app.waitForDatabase(ctx, app.config.db.connectAttempts)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		err = app.db.Migrate()
+
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("%q is not a number of migrations", args[1])
+			}
+		}
+		err = app.db.MigrateSteps(-steps)
+
+	case args[0] == "force" && len(args) == 2:
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			return fmt.Errorf("%q is not a migration version", args[1])
+		}
+		err = app.db.ForceMigration(version)
+
+	case args[0] == "version" && len(args) == 1:
+		version, dirty, err := app.db.MigrationVersion(ctx)
+		if err != nil {
+			return err
+		}
+		latest, err := database.LatestMigration()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version: %d\ndirty: %t\nlatest: %d\n", version, dirty, latest)
+		return nil
+
+	default:
+		return fmt.Errorf("unexpected arguments %q, see %s migrate -h", args, programName)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := app.db.MigrationVersion(ctx)
+	if err != nil {
+		return err
+	}
+	app.logger.Info("migrated", "version", version, "dirty", dirty)
+	return nil
+}
+
+// stats is the stats command
+func (app *application) stats() error {
+	ctx := context.Background()
+	if len(app.config.args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", app.config.args)
+	}
+	if app.config.stats.limit < 1 {
+		return fmt.Errorf("limit must be more than 0")
+	}
+
+	err := app.requireSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	totals, err := app.db.Totals(ctx)
+	if err != nil {
+		return err
+	}
+	sites, err := app.db.TopSites(ctx, app.config.stats.limit)
+	if err != nil {
+		return err
+	}
+	emoji, err := app.db.TopEmoji(ctx, app.config.stats.limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Sites:\t%d\nReactions:\t%d\n\n", totals.Sites, totals.Reactions)
+
+	fmt.Fprintf(tw, "SITE\tREACTIONS\n")
+	for _, site := range sites {
+		fmt.Fprintf(tw, "%s\t%d\n", site.Url, site.Reactions)
+	}
+
+	fmt.Fprintf(tw, "\nEMOJI\tREACTIONS\tSITES\n")
+	for _, e := range emoji {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", e.Emoji, e.Reactions, e.Sites)
+	}
+
+	return tw.Flush()
+}
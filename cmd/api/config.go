@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"openheart.tylery.com/internal/certs"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/tracing"
+	"openheart.tylery.com/internal/validator"
+)
+
+// configVars registers every setting once, as a flag. The same name is its key in the config file, and each
+// has its own environment variable. Layering them is then a matter of setting the flags again in order of
+// precedence: the config file, the environment, and the flags given on the command line.
+type configVars struct {
+	flags *flag.FlagSet
+	env   map[string]string // Flag name to environment variable
+}
+
+func (c *configVars) stringVar(p *string, name string, envKey string, value string, usage string) {
+	c.flags.StringVar(p, name, value, c.usage(usage, envKey))
+	c.env[name] = envKey
+}
+
+func (c *configVars) intVar(p *int, name string, envKey string, value int, usage string) {
+	c.flags.IntVar(p, name, value, c.usage(usage, envKey))
+	c.env[name] = envKey
+}
+
+func (c *configVars) float64Var(p *float64, name string, envKey string, value float64, usage string) {
+	c.flags.Float64Var(p, name, value, c.usage(usage, envKey))
+	c.env[name] = envKey
+}
+
+func (c *configVars) boolVar(p *bool, name string, envKey string, value bool, usage string) {
+	c.flags.BoolVar(p, name, value, c.usage(usage, envKey))
+	c.env[name] = envKey
+}
+
+func (c *configVars) durationVar(p *time.Duration, name string, envKey string, value time.Duration, usage string) {
+	c.flags.DurationVar(p, name, value, c.usage(usage, envKey))
+	c.env[name] = envKey
+}
+
+func (c *configVars) usage(usage string, envKey string) string {
+	return fmt.Sprintf("%s (env %s)", usage, envKey)
+}
+
+// set applies a value from one of the layers, recording why it can't be used if it doesn't parse
+func (c *configVars) set(v *validator.Validator, key string, name string, value string) {
+	f := c.flags.Lookup(name)
+	previous := f.Value.String()
+
+	// A value that doesn't parse still overwrites the old one with a zero, which would fail validation too
+	err := c.flags.Set(name, value)
+	if err != nil {
+		_ = c.flags.Set(name, previous)
+		v.AddFieldError(key, fmt.Sprintf("%q is not a valid %s", value, valueKind(f)))
+	}
+}
+
+// loadConfig reads the configuration from, in increasing precedence, the defaults, the config file, the
+// environment and the command line flags. Every problem is reported at once in the returned error.
+//
+// The first argument names the command to run, serve unless it's a flag. Commands can have flags of their own,
+// which are only read from the command line.
+func loadConfig(args []string) (config, error) {
+	var cfg config
+	var configFile string
+
+	name, args := splitCommand(args)
+	cmd, found := findCommand(name)
+	if !found {
+		return config{}, fmt.Errorf("unknown command %q, see %s help", name, programName)
+	}
+
+	c := &configVars{flags: flag.NewFlagSet(programName+" "+name, flag.ContinueOnError), env: map[string]string{}}
+	c.flags.Usage = func() { cmd.usage(c.flags) }
+
+	c.stringVar(&configFile, "config", "CONFIG_FILE", "", "TOML file to read configuration from")
+
+	c.intVar(&cfg.httpPort, "http-port", "HTTP_PORT", 4444, "Port for the HTTP server")
+	c.stringVar(&cfg.unixSocket.path, "unix-socket", "UNIX_SOCKET", "", "Unix domain socket to serve on instead of http-port")
+	c.stringVar(&cfg.unixSocket.mode, "unix-socket-mode", "UNIX_SOCKET_MODE", "0660", "Permissions of the Unix domain socket, in octal")
+	c.durationVar(&cfg.server.idleTimeout, "idle-timeout", "IDLE_TIMEOUT", defaultIdleTimeout, "How long to keep idle connections open")
+	c.durationVar(&cfg.server.readTimeout, "read-timeout", "READ_TIMEOUT", defaultReadTimeout, "How long a client may take to send its request")
+	c.durationVar(&cfg.server.writeTimeout, "write-timeout", "WRITE_TIMEOUT", defaultWriteTimeout, "How long a response may take, streams aside")
+	c.durationVar(&cfg.server.shutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", defaultShutdownPeriod, "How long to wait for requests to finish on shutdown")
+	c.boolVar(&cfg.server.http2, "http2", "HTTP2", true, "Serve HTTP/2 to clients that support it, over TLS")
+	c.durationVar(&cfg.drainDelay, "drain-delay", "DRAIN_DELAY", 0, "How long to keep serving after a shutdown signal, with /readyz failing, so load balancers stop sending traffic first")
+	c.durationVar(&cfg.restartTimeout, "restart-timeout", "RESTART_TIMEOUT", defaultRestartTimeout, "How long a restart on SIGUSR2 waits for the new process to be ready before giving up on it")
+
+	c.stringVar(&cfg.tls.certFiles, "tls-cert", "TLS_CERT", "", "Comma separated PEM certificate files, which serves HTTPS on http-port instead of HTTP")
+	c.stringVar(&cfg.tls.keyFiles, "tls-key", "TLS_KEY", "", "Comma separated PEM private key files, one for each certificate")
+	c.intVar(&cfg.tls.redirectPort, "redirect-port", "REDIRECT_PORT", 0, "Port to redirect HTTP to HTTPS from, with TLS (0 disables it)")
+	c.intVar(&cfg.tls.publicPort, "https-public-port", "HTTPS_PUBLIC_PORT", 0, "Port clients reach HTTPS on, which HTTP is redirected to (0 is the port it's served on)")
+
+	c.stringVar(&cfg.db.dsn, "dsn", "DB_DSN", "user:pass@localhost:3306/db", "Database DSN, user:password@tcp(host:port)/database")
+	c.intVar(&cfg.db.connectAttempts, "db-connect-attempts", "DB_CONNECT_ATTEMPTS", 10, "How many times to try reaching the database on startup (0 keeps trying)")
+	c.durationVar(&cfg.db.connectBackoff, "db-connect-backoff", "DB_CONNECT_BACKOFF", time.Second, "How long to wait before trying the database again, doubling every attempt")
+	c.boolVar(&cfg.db.startDegraded, "start-degraded", "START_DEGRADED", false, "Start serving without the database, and keep trying to reach it in the background")
+	c.stringVar(&cfg.db.migrate, "migrate", "MIGRATE", migrateAuto, "How serve treats the database schema: auto migrates it, verify refuses to start if it's behind, and off does neither")
+	c.intVar(&cfg.db.pool.MaxOpenConns, "db-max-open-conns", "DB_MAX_OPEN_CONNS", 25, "Most connections open to the database")
+	c.intVar(&cfg.db.pool.MaxIdleConns, "db-max-idle-conns", "DB_MAX_IDLE_CONNS", 25, "Most idle connections kept open to the database")
+	c.durationVar(&cfg.db.pool.ConnMaxIdleTime, "db-conn-max-idle-time", "DB_CONN_MAX_IDLE_TIME", 5*time.Minute, "How long a database connection may sit idle before it's closed")
+	c.durationVar(&cfg.db.pool.ConnMaxLifetime, "db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", 2*time.Hour, "How long a database connection is reused for")
+
+	c.boolVar(&cfg.recordReactions, "record-reactions", "RECORD_REACTIONS", false, "Keep every reaction on its own, with when it was made, for export -reactions, as well as the counts")
+
+	c.durationVar(&cfg.prune.interval, "prune-interval", "PRUNE_INTERVAL", 0, "How often serve prunes stale sites and compacts old reactions (0 leaves it to the prune command)")
+	c.intVar(&cfg.prune.idleDays, "prune-idle-days", "PRUNE_IDLE_DAYS", 0, "Days without a reaction after which a site with at most prune-max-reactions is pruned (0 never prunes sites)")
+	c.intVar(&cfg.prune.maxReactions, "prune-max-reactions", "PRUNE_MAX_REACTIONS", 0, "Most reactions a site can have and still be pruned")
+	c.boolVar(&cfg.prune.archive, "prune-archive", "PRUNE_ARCHIVE", true, "Keep the url and counts of pruned sites in the site_archive table")
+	c.intVar(&cfg.prune.compactDays, "prune-compact-days", "PRUNE_COMPACT_DAYS", 0, "Days after which single reactions are rolled up into daily counts (0 never compacts them)")
+	c.boolVar(&cfg.prune.dryRun, "prune-dry-run", "PRUNE_DRY_RUN", false, "Report what pruning would do without changing anything")
+
+	c.intVar(&cfg.webhooks.workers, "webhook-workers", "WEBHOOK_WORKERS", 8, "How many webhook targets are delivered to at once")
+	c.boolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", "WEBHOOK_ALLOW_PRIVATE", false, "Deliver webhooks to loopback, link-local and private addresses")
+
+	c.stringVar(&cfg.adminToken, "admin-token", "ADMIN_TOKEN", "", "Bearer token for the admin API (admin API disabled when empty)")
+	c.intVar(&cfg.adminPort, "admin-port", "ADMIN_PORT", 4445, "Port for /metrics and the health checks, kept off the public port (0 disables it)")
+
+	c.durationVar(&cfg.cacheMaxAge, "cache-max-age", "CACHE_MAX_AGE", 30*time.Second, "How long clients may cache reaction counts")
+	c.intVar(&cfg.countsCache.size, "counts-cache-size", "COUNTS_CACHE_SIZE", 10000, "How many sites to cache counts for (0 disables the cache)")
+	c.durationVar(&cfg.countsCache.ttl, "counts-cache-ttl", "COUNTS_CACHE_TTL", 10*time.Second, "How long cached counts are used before reading them again")
+
+	c.float64Var(&cfg.rateLimit.rps, "rate-limit-rps", "RATE_LIMIT_RPS", 1, "Reactions a second each client may make, on average (0 disables the limit)")
+	c.intVar(&cfg.rateLimit.burst, "rate-limit-burst", "RATE_LIMIT_BURST", 20, "Reactions each client may make at once, before the rate limit applies")
+
+	c.stringVar(&cfg.blocked.clients, "blocked-clients", "BLOCKED_CLIENTS", "", "Comma separated IP addresses and CIDR ranges whose reactions are refused")
+	c.stringVar(&cfg.blocked.sites, "blocked-sites", "BLOCKED_SITES", "", "Comma separated URLs that can't be reacted to")
+	c.stringVar(&cfg.cors.origins, "cors-origins", "CORS_ORIGINS", "", "Comma separated origins that may react to sites without allowed origins of their own (any origin when empty)")
+
+	c.stringVar(&cfg.logLevel, "log-level", "LOG_LEVEL", "info", "Least severe level to log: debug, info, warn or error")
+	c.stringVar(&cfg.tracing.exporter, "trace-exporter", "TRACE_EXPORTER", tracing.ExporterNone, "Where to send traces: none, stdout or otlp (configured through OTEL_EXPORTER_OTLP_*)")
+	c.stringVar(&cfg.tracing.file, "trace-file", "TRACE_FILE", "", "File the stdout exporter appends traces to, rather than stderr")
+
+	if cmd.flags != nil {
+		cmd.flags(c.flags, &cfg)
+	}
+
+	err := c.flags.Parse(args)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.command = name
+	cfg.args = c.flags.Args()
+
+	// The file and environment are applied on top of the flags, so the flags given are put back afterwards
+	given := map[string]string{}
+	c.flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	var v validator.Validator
+
+	if _, ok := given["config"]; !ok {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		c.loadFile(&v, configFile)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.env)) {
+		value, exists := os.LookupEnv(c.env[name])
+		if exists && name != "config" {
+			c.set(&v, c.env[name], name, value)
+		}
+	}
+
+	for name, value := range given {
+		c.set(&v, name, name, value)
+	}
+
+	cfg.validate(&v)
+	cfg.parseLists(&v)
+
+	if v.HasErrors() {
+		return config{}, configError(v)
+	}
+
+	cfg.values = map[string]string{}
+	c.flags.VisitAll(func(f *flag.Flag) {
+		cfg.values[f.Name] = f.Value.String()
+	})
+	return cfg, nil
+}
+
+// loadFile applies a TOML config file. Keys are flag names, and tables prefix the keys inside them, so
+//
+//	[db]
+//	max-open-conns = 50
+//
+// sets db-max-open-conns.
+func (c *configVars) loadFile(v *validator.Validator, path string) {
+	var file map[string]any
+	_, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		v.AddError(fmt.Sprintf("unable to read config file %s: %s", path, err))
+		return
+	}
+
+	c.loadTable(v, "", file)
+}
+
+func (c *configVars) loadTable(v *validator.Validator, prefix string, table map[string]any) {
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		name := prefix + key
+
+		switch value := table[key].(type) {
+		case map[string]any:
+			c.loadTable(v, name+"-", value)
+		case []any:
+			// Lists are given to the flags comma separated
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			c.loadValue(v, name, strings.Join(items, ","))
+		case string, int64, float64, bool:
+			c.loadValue(v, name, fmt.Sprint(value))
+		default:
+			v.AddFieldError(name, "must be a string, number, boolean or list")
+		}
+	}
+}
+
+func (c *configVars) loadValue(v *validator.Validator, name string, value string) {
+	if _, isSetting := c.env[name]; !isSetting || name == "config" {
+		v.AddFieldError(name, "is not a setting")
+		return
+	}
+	c.set(v, name, name, value)
+}
+
+func (cfg config) validate(v *validator.Validator) {
+	v.CheckField(validator.Between(cfg.httpPort, 1, 65535), "http-port", "must be a port between 1 and 65535")
+	v.CheckField(validator.Between(cfg.adminPort, 0, 65535), "admin-port", "must be a port between 1 and 65535, or 0")
+	v.CheckField(cfg.adminPort != cfg.httpPort, "admin-port", "must not be the same as http-port")
+	v.CheckField(validator.Between(cfg.tls.redirectPort, 0, 65535), "redirect-port", "must be a port between 1 and 65535, or 0")
+	v.CheckField(cfg.tls.redirectPort == 0 || validator.NotIn(cfg.tls.redirectPort, cfg.httpPort, cfg.adminPort), "redirect-port", "must not be the same as http-port or admin-port")
+	v.CheckField(cfg.tls.redirectPort == 0 || cfg.tls.certFiles != "", "redirect-port", "needs tls-cert and tls-key")
+	v.CheckField(validator.Between(cfg.tls.publicPort, 0, 65535), "https-public-port", "must be a port between 1 and 65535, or 0")
+	v.CheckField(cfg.tls.publicPort == 0 || cfg.tls.redirectPort != 0, "https-public-port", "needs redirect-port")
+	v.CheckField(len(splitList(cfg.tls.certFiles)) == len(splitList(cfg.tls.keyFiles)), "tls-key", "must have one key for each of tls-cert")
+
+	v.CheckField(cfg.server.idleTimeout > 0, "idle-timeout", "must be more than 0")
+	v.CheckField(cfg.server.readTimeout > 0, "read-timeout", "must be more than 0")
+	v.CheckField(cfg.server.writeTimeout > 0, "write-timeout", "must be more than 0")
+	v.CheckField(cfg.server.shutdownTimeout > 0, "shutdown-timeout", "must be more than 0")
+	v.CheckField(cfg.drainDelay >= 0, "drain-delay", "must not be negative")
+	v.CheckField(cfg.restartTimeout > 0, "restart-timeout", "must be more than 0")
+
+	v.CheckField(validator.NotBlank(cfg.db.dsn), "dsn", "must be provided")
+	v.CheckField(validator.In(cfg.db.migrate, migrateAuto, migrateVerify, migrateOff), "migrate", "must be auto, verify or off")
+	v.CheckField(cfg.db.connectAttempts >= 0, "db-connect-attempts", "must not be negative")
+	v.CheckField(cfg.db.connectBackoff > 0, "db-connect-backoff", "must be more than 0")
+	v.CheckField(cfg.db.pool.MaxOpenConns > 0, "db-max-open-conns", "must be more than 0")
+	v.CheckField(validator.Between(cfg.db.pool.MaxIdleConns, 0, cfg.db.pool.MaxOpenConns), "db-max-idle-conns", "must be between 0 and db-max-open-conns")
+	v.CheckField(cfg.db.pool.ConnMaxIdleTime >= 0, "db-conn-max-idle-time", "must not be negative")
+	v.CheckField(cfg.db.pool.ConnMaxLifetime >= 0, "db-conn-max-lifetime", "must not be negative")
+
+	v.CheckField(cfg.prune.interval >= 0, "prune-interval", "must not be negative")
+	v.CheckField(cfg.prune.interval == 0 || cfg.prune.idleDays > 0 || cfg.prune.compactDays > 0, "prune-interval", "needs prune-idle-days or prune-compact-days")
+	v.CheckField(cfg.prune.idleDays >= 0, "prune-idle-days", "must not be negative")
+	v.CheckField(cfg.prune.maxReactions >= 0, "prune-max-reactions", "must not be negative")
+	v.CheckField(cfg.prune.compactDays >= 0, "prune-compact-days", "must not be negative")
+
+	v.CheckField(cfg.webhooks.workers > 0, "webhook-workers", "must be more than 0")
+
+	v.CheckField(cfg.cacheMaxAge >= 0, "cache-max-age", "must not be negative")
+	v.CheckField(cfg.countsCache.size >= 0, "counts-cache-size", "must not be negative")
+	v.CheckField(cfg.countsCache.ttl > 0, "counts-cache-ttl", "must be more than 0")
+
+	v.CheckField(cfg.rateLimit.rps >= 0, "rate-limit-rps", "must not be negative")
+	v.CheckField(cfg.rateLimit.burst > 0, "rate-limit-burst", "must be more than 0")
+
+	v.CheckField(validator.In(cfg.logLevel, "debug", "info", "warn", "error"), "log-level", "must be debug, info, warn or error")
+	v.CheckField(validator.In(cfg.tracing.exporter, tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP), "trace-exporter", "must be none, stdout or otlp")
+	v.CheckField(cfg.tracing.file == "" || cfg.tracing.exporter == tracing.ExporterStdout, "trace-file", "needs trace-exporter stdout")
+}
+
+// parseLists reads the comma separated settings into the forms they're used in
+func (cfg *config) parseLists(v *validator.Validator) {
+	for _, client := range splitList(cfg.blocked.clients) {
+		prefix, err := netip.ParsePrefix(client)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(client)
+			if addrErr != nil {
+				v.AddFieldError("blocked-clients", fmt.Sprintf("%q is not an IP address or CIDR range", client))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.blocked.clientPrefixes = append(cfg.blocked.clientPrefixes, prefix.Masked())
+	}
+
+	mode, err := strconv.ParseUint(cfg.unixSocket.mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		v.AddFieldError("unix-socket-mode", "must be octal permissions, like 0660")
+	}
+	cfg.unixSocket.fileMode = fs.FileMode(mode)
+
+	certFiles, keyFiles := splitList(cfg.tls.certFiles), splitList(cfg.tls.keyFiles)
+	for i := range min(len(certFiles), len(keyFiles)) {
+		cfg.tls.pairs = append(cfg.tls.pairs, certs.Pair{CertFile: certFiles[i], KeyFile: keyFiles[i]})
+	}
+
+	for _, site := range splitList(cfg.blocked.sites) {
+		parsedUrl, err := request.InputUrl(site).Parse()
+		if err != nil {
+			v.AddFieldError("blocked-sites", fmt.Sprintf("%q is not a valid URL", site))
+			continue
+		}
+		cfg.blocked.siteUrls = append(cfg.blocked.siteUrls, parsedUrl)
+	}
+
+	for _, origin := range splitList(cfg.cors.origins) {
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			v.AddFieldError("cors-origins", fmt.Sprintf("%q must be an http or https origin, without a path", origin))
+			continue
+		}
+		cfg.cors.originList = append(cfg.cors.originList, normalized)
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func configError(v validator.Validator) error {
+	problems := slices.Clone(v.Errors)
+	for _, key := range slices.Sorted(maps.Keys(v.FieldErrors)) {
+		problems = append(problems, key+" "+v.FieldErrors[key])
+	}
+
+	return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+}
+
+func valueKind(f *flag.Flag) string {
+	switch f.Value.(flag.Getter).Get().(type) {
+	case int:
+		return "whole number"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case time.Duration:
+		return "duration, like 30s or 5m"
+	default:
+		return "value"
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configTest sets up one layer of configuration each: a TOML file given by CONFIG_FILE, environment variables
+// and the command line
+type configTest struct {
+	name string
+	file string
+	env  map[string]string
+	args []string
+}
+
+func (tt configTest) load(t *testing.T) (config, error) {
+	t.Helper()
+
+	// Nothing the tests look at comes from the environment they run in
+	for _, key := range []string{"CONFIG_FILE", "HTTP_PORT", "ADMIN_PORT", "DB_DSN", "DB_MAX_OPEN_CONNS", "HTTP2", "READ_TIMEOUT", "CORS_ORIGINS", "CACHE_MAX_AGE"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	if tt.file != "" {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		err := os.WriteFile(path, []byte(tt.file), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+	}
+	for key, value := range tt.env {
+		t.Setenv(key, value)
+	}
+
+	return loadConfig(append([]string{programName}, tt.args...))
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	const file = `
+http-port = 5000
+http2 = false
+dsn = "file@tcp(db:3306)/openheart"
+
+[db]
+max-open-conns = 50
+`
+
+	tests := []struct {
+		configTest
+		want map[string]string
+	}{
+		{
+			configTest: configTest{name: "defaults"},
+			want:       map[string]string{"http-port": "4444", "http2": "true", "db-max-open-conns": "25", "cache-max-age": "30s"},
+		},
+		{
+			configTest: configTest{name: "file", file: file},
+			want:       map[string]string{"http-port": "5000", "http2": "false", "db-max-open-conns": "50", "dsn": "file@tcp(db:3306)/openheart"},
+		},
+		{
+			configTest: configTest{name: "environment over file", file: file, env: map[string]string{"HTTP_PORT": "6000", "DB_DSN": "env@tcp(db:3306)/openheart"}},
+			want:       map[string]string{"http-port": "6000", "http2": "false", "db-max-open-conns": "50", "dsn": "env@tcp(db:3306)/openheart"},
+		},
+		{
+			configTest: configTest{name: "flags over environment and file", file: file, env: map[string]string{"HTTP_PORT": "6000"}, args: []string{"-http-port", "7000", "-db-max-open-conns", "60"}},
+			want:       map[string]string{"http-port": "7000", "http2": "false", "db-max-open-conns": "60"},
+		},
+		{
+			// Flags are applied again after the file and environment, so one given with its default value still wins
+			configTest: configTest{name: "flags given their defaults", file: file, env: map[string]string{"HTTP_PORT": "6000"}, args: []string{"-http-port", "4444", "-http2=true"}},
+			want:       map[string]string{"http-port": "4444", "http2": "true", "db-max-open-conns": "50"},
+		},
+		{
+			configTest: configTest{name: "command flags", file: file, args: []string{"export", "-format", "csv", "-http-port", "7000"}},
+			want:       map[string]string{"format": "csv", "http-port": "7000", "db-max-open-conns": "50"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.load(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := cfg.values[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		configTest
+		want []string
+	}{
+		{
+			configTest: configTest{name: "unknown command", args: []string{"frobnicate"}},
+			want:       []string{`unknown command "frobnicate"`},
+		},
+		{
+			configTest: configTest{name: "unreadable file", file: "http-port = "},
+			want:       []string{"unable to read config file"},
+		},
+		{
+			// Every layer's problems are reported at once, each against its own key
+			configTest: configTest{
+				name: "every layer",
+				file: "http-port = \"lots\"\nbogus = 1\n[db]\nmax-open-conns = [1, 2]\n",
+				env:  map[string]string{"READ_TIMEOUT": "soon", "CORS_ORIGINS": "example.com/path"},
+				args: []string{"-admin-port", "4444"},
+			},
+			want: []string{
+				`http-port "lots" is not a valid whole number`,
+				"bogus is not a setting",
+				`db-max-open-conns "1,2" is not a valid whole number`,
+				`READ_TIMEOUT "soon" is not a valid duration`,
+				`cors-origins "example.com/path" must be an http or https origin`,
+				"admin-port must not be the same as http-port",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.load(t)
+			if err == nil {
+				t.Fatal("loaded without an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't include %q", err, want)
+				}
+			}
+		})
+	}
+}
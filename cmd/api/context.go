@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	requestIdContextKey     = contextKey("requestId")
+	requestLoggerContextKey = contextKey("requestLogger")
+)
+
+func contextSetRequestId(r *http.Request, requestId string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIdContextKey, requestId)
+	return r.WithContext(ctx)
+}
+
+func contextGetRequestId(r *http.Request) string {
+	requestId, _ := r.Context().Value(requestIdContextKey).(string)
+	return requestId
+}
+
+func contextSetLogger(r *http.Request, logger *slog.Logger) *http.Request {
+	ctx := context.WithValue(r.Context(), requestLoggerContextKey, logger)
+	return r.WithContext(ctx)
+}
+
+// requestLogger returns the logger for a request, which labels everything it logs with the request id.
+// Requests that didn't come through logRequests get the application's logger.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	logger, ok := r.Context().Value(requestLoggerContextKey).(*slog.Logger)
+	if !ok {
+		return app.logger
+	}
+	return logger
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/validator"
+)
+
+const (
+	corsMaxAge        = 10 * time.Minute
+	corsExposeHeaders = "ETag"
+)
+
+// cors applies the CORS policy of the sites a request is for. Sites without allowed origins can be called
+// from the configured origins, or from anywhere if there are none. The rest only answer to their own origins,
+// and refuse reactions from any other.
+//
+// Preflights are answered here, as the muxes have no OPTIONS routes. The mux is probed with the method
+// being asked about instead, so only routes that exist are allowed.
+func (app *application) cors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by origin, whether there is one or not, so caches mustn't share them between origins
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Method
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			method = r.Header.Get("Access-Control-Request-Method")
+		}
+
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		_, pattern := mux.Handler(probe)
+
+		restricted, allowed := false, pattern != ""
+		if allowed {
+			var err error
+			restricted, allowed, err = app.originAllowed(r.Context(), origin, corsSites(r, pattern))
+			if err != nil {
+				app.corsError(w, r, err)
+				return
+			}
+		}
+
+		if allowed {
+			if restricted {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+
+		if preflight {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", method)
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// A browser won't let a page read the response without the headers, but simple requests are sent
+		// all the same. Reactions from other origins are refused outright.
+		if !allowed && pattern != "" && method != http.MethodGet && method != http.MethodHead {
+			app.corsForbidden(w, r)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed checks an origin against the policy of every site. restricted reports whether any of them
+// limits its origins, in which case the origin has to be echoed back rather than allowing any.
+func (app *application) originAllowed(ctx context.Context, origin string, sites []string) (restricted bool, allowed bool, err error) {
+	for _, site := range sites {
+		origins, err := app.allowedOrigins(ctx, site)
+		if err != nil {
+			return false, false, err
+		}
+		// Sites without origins of their own fall back to the configured ones
+		if len(origins) == 0 {
+			origins = app.currentSettings().corsOrigins
+		}
+		if len(origins) == 0 {
+			continue
+		}
+
+		restricted = true
+		normalized, err := normalizeOrigin(origin)
+		if err != nil || validator.NotIn(normalized, origins...) {
+			return true, false, nil
+		}
+	}
+
+	return restricted, true, nil
+}
+
+// allowedOrigins returns a site's own allowed origins, none when the site doesn't exist, from the origins
+// cache when it's enabled. Without the database, it's the last origins known for the site, or none, so the
+// site falls back to cors-origins rather than every browser request failing.
+func (app *application) allowedOrigins(ctx context.Context, site string) ([]string, error) {
+	if app.originsCache != nil {
+		if origins, ok := app.originsCache.Get(site); ok {
+			return origins, nil
+		}
+	}
+
+	load := func() ([]string, error) {
+		origins, err := app.db.AllowedOrigins(ctx, site)
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, nil
+		}
+		return origins, err
+	}
+
+	var origins []string
+	err := errDatabaseUnavailable
+	switch {
+	case !app.databaseReady():
+	case app.originsCache == nil:
+		origins, err = load()
+	default:
+		origins, err = app.originsCache.Load(site, load)
+	}
+	if !app.isUnavailable(err) {
+		return origins, err
+	}
+
+	if app.originsCache != nil {
+		origins, _ = app.originsCache.GetStale(site)
+	}
+	return origins, nil
+}
+
+// corsSites returns the sites a request is for, taken from the {url...} wildcard of the pattern it matched,
+// or failing that, from its url query parameters
+func corsSites(r *http.Request, pattern string) []string {
+	var rawUrls []string
+
+	_, path, _ := strings.Cut(pattern, " ")
+	if prefix, found := strings.CutSuffix(path, "{url...}"); found {
+		rawUrl := strings.TrimPrefix(r.URL.Path, prefix)
+		if prefix == "/badge/" {
+			rawUrl = strings.TrimSuffix(rawUrl, ".svg")
+		}
+		rawUrls = []string{rawUrl}
+	} else {
+		rawUrls = r.URL.Query()["url"]
+	}
+
+	var sites []string
+	for _, rawUrl := range rawUrls {
+		parsedUrl, err := request.InputUrl(rawUrl).Parse()
+		if err == nil {
+			sites = append(sites, parsedUrl)
+		}
+	}
+	return sites
+}
+
+// normalizeOrigin reduces an origin to the lowercase scheme://host[:port] form browsers send
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if validator.NotIn(u.Scheme, "http", "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+		return "", errors.New("must be an http or https origin, without a path")
+	}
+
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+func (app *application) corsForbidden(w http.ResponseWriter, r *http.Request) {
+	// Sites only restrict reactions, which are the only POSTs to carry a site
+	if r.Method == http.MethodPost {
+		app.rejectReaction(errCodeForbidden)
+	}
+
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		app.apiForbidden(w, r, "this site doesn't accept reactions from your origin")
+		return
+	}
+	app.protocolError(w, r, http.StatusForbidden, "FORBIDDEN")
+}
+
+func (app *application) corsError(w http.ResponseWriter, r *http.Request, err error) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		app.apiServerError(w, r, err)
+		return
+	}
+	app.serverError(w, r, err)
+}
+
+func (app *application) apiGetSite(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.PathValue("url")).Parse()
+	if err != nil {
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	origins, err := app.db.AllowedOrigins(r.Context(), parsedUrl)
+	if errors.Is(err, database.ErrNotFound) {
+		app.apiNotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	app.apiResponse(w, r, http.StatusOK, database.Site{Url: parsedUrl, Origins: origins}, nil)
+}
+
+func (app *application) apiUpdateSite(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.PathValue("url")).Parse()
+	if err != nil {
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	var input struct {
+		Origins []string `json:"origins"`
+	}
+
+	err = request.DecodeJSONStrict(w, r, &input)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	var v validator.Validator
+	origins := make([]string, 0, len(input.Origins))
+	for _, origin := range input.Origins {
+		normalized, err := normalizeOrigin(origin)
+		v.CheckField(err == nil, origin, "must be an http or https origin, without a path")
+		if err == nil && validator.NotIn(normalized, origins...) {
+			origins = append(origins, normalized)
+		}
+	}
+	v.CheckField(validator.MaxRunes(strings.Join(origins, " "), 2048), "origins", "must not be more than 2048 characters long in total")
+
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	site, err := app.db.SetAllowedOrigins(r.Context(), parsedUrl, origins)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	if app.originsCache != nil {
+		app.originsCache.Delete(parsedUrl)
+	}
+
+	app.apiResponse(w, r, http.StatusOK, site, nil)
+}
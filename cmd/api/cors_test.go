@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"openheart.tylery.com/internal/cache"
+)
+
+// newCorsApp returns an app without a database, where locked.com only allows its own origin and every other
+// site falls back to corsOrigins
+func newCorsApp(corsOrigins ...string) *application {
+	app := &application{
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		originsCache: cache.New[[]string](10, time.Hour),
+		metrics: &metrics{
+			reactions: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "reactions_total"}, []string{"result", "reason"}),
+		},
+	}
+	app.settings.Store(&settings{corsOrigins: corsOrigins})
+	app.originsCache.Load("locked.com", func() ([]string, error) { return []string{"https://locked.com"}, nil })
+	return app
+}
+
+// newCorsHandler splits the routes between two muxes behind cors, as routes does. Neither has OPTIONS routes,
+// so a preflight that reaches one gets a teapot.
+func newCorsHandler(app *application) http.Handler {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	teapot := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /badge/{url...}", ok)
+	mux.HandleFunc("GET /{url...}", ok)
+	mux.HandleFunc("POST /{url...}", ok)
+	mux.HandleFunc("OPTIONS /", teapot)
+
+	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("GET "+apiPrefix+"/counts", ok)
+	apiMux.HandleFunc("POST "+apiPrefix+"/reactions/{url...}", ok)
+	apiMux.HandleFunc("OPTIONS "+apiPrefix+"/", teapot)
+
+	root, api := app.cors(mux), app.cors(apiMux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			api.ServeHTTP(w, r)
+			return
+		}
+		root.ServeHTTP(w, r)
+	})
+}
+
+func TestCors(t *testing.T) {
+	tests := []struct {
+		name        string
+		corsOrigins []string
+		method      string
+		target      string
+		origin      string
+		wantStatus  int
+		wantOrigin  string
+	}{
+		{name: "no origin", method: http.MethodGet, target: "/locked.com", wantStatus: http.StatusOK},
+		{name: "open site", method: http.MethodPost, target: "/open.com", origin: "https://elsewhere.net", wantStatus: http.StatusOK, wantOrigin: "*"},
+		{name: "own origin", method: http.MethodPost, target: "/locked.com", origin: "https://locked.com", wantStatus: http.StatusOK, wantOrigin: "https://locked.com"},
+		{name: "own origin in another case", method: http.MethodPost, target: "/locked.com", origin: "HTTPS://Locked.com", wantStatus: http.StatusOK, wantOrigin: "HTTPS://Locked.com"},
+		{name: "read from another origin", method: http.MethodGet, target: "/locked.com", origin: "https://elsewhere.net", wantStatus: http.StatusOK},
+		{name: "reaction from another origin", method: http.MethodPost, target: "/locked.com", origin: "https://elsewhere.net", wantStatus: http.StatusForbidden},
+		{name: "api reaction from another origin", method: http.MethodPost, target: apiPrefix + "/reactions/locked.com", origin: "https://elsewhere.net", wantStatus: http.StatusForbidden},
+		{name: "badge", method: http.MethodGet, target: "/badge/locked.com.svg", origin: "https://locked.com", wantStatus: http.StatusOK, wantOrigin: "https://locked.com"},
+		{name: "query sites", method: http.MethodGet, target: apiPrefix + "/counts?url=open.com&url=locked.com", origin: "https://locked.com", wantStatus: http.StatusOK, wantOrigin: "https://locked.com"},
+		{name: "query sites from another origin", method: http.MethodGet, target: apiPrefix + "/counts?url=open.com&url=locked.com", origin: "https://elsewhere.net", wantStatus: http.StatusOK},
+		{name: "cors-origins", corsOrigins: []string{"https://open.com"}, method: http.MethodPost, target: "/open.com", origin: "https://open.com", wantStatus: http.StatusOK, wantOrigin: "https://open.com"},
+		{name: "cors-origins from another origin", corsOrigins: []string{"https://open.com"}, method: http.MethodPost, target: "/open.com", origin: "https://elsewhere.net", wantStatus: http.StatusForbidden},
+		{name: "site origins over cors-origins", corsOrigins: []string{"https://elsewhere.net"}, method: http.MethodPost, target: "/locked.com", origin: "https://elsewhere.net", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newCorsApp(tt.corsOrigins...)
+
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			newCorsHandler(app).ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Origin" {
+				t.Errorf("Vary = %q, want Origin", got)
+			}
+
+			rejected := testutil.ToFloat64(app.metrics.reactions.WithLabelValues(reactionRejected, errCodeForbidden))
+			if want := tt.wantStatus == http.StatusForbidden; (rejected == 1) != want {
+				t.Errorf("forbidden reactions = %v, want %t", rejected, want)
+			}
+		})
+	}
+}
+
+// Preflights are answered without reaching the handlers, allowing only the methods the mux has routes for
+func TestCorsPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		origin      string
+		method      string
+		wantOrigin  string
+		wantMethods string
+	}{
+		{name: "reaction", target: "/open.com", origin: "https://elsewhere.net", method: http.MethodPost, wantOrigin: "*", wantMethods: http.MethodPost},
+		{name: "own origin", target: "/locked.com", origin: "https://locked.com", method: http.MethodPost, wantOrigin: "https://locked.com", wantMethods: http.MethodPost},
+		{name: "another origin", target: "/locked.com", origin: "https://elsewhere.net", method: http.MethodPost},
+		{name: "method without a route", target: "/open.com", origin: "https://elsewhere.net", method: http.MethodDelete},
+		{name: "route without the method", target: apiPrefix + "/counts?url=open.com", origin: "https://elsewhere.net", method: http.MethodPost},
+		{name: "api reaction", target: apiPrefix + "/reactions/open.com", origin: "https://elsewhere.net", method: http.MethodPost, wantOrigin: "*", wantMethods: http.MethodPost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newCorsApp()
+
+			r := httptest.NewRequest(http.MethodOptions, tt.target, nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", tt.method)
+			r.Header.Set("Access-Control-Request-Headers", "content-type")
+			rec := httptest.NewRecorder()
+			newCorsHandler(app).ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+
+			want := http.Header{"Vary": {"Origin"}}
+			if tt.wantOrigin != "" {
+				want.Set("Access-Control-Allow-Origin", tt.wantOrigin)
+				want.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+				want.Set("Access-Control-Allow-Methods", tt.wantMethods)
+				want.Set("Access-Control-Allow-Headers", "content-type")
+				want.Set("Access-Control-Max-Age", "600")
+			}
+			for name := range headerNames(want, rec.Header()) {
+				if got, want := rec.Header().Get(name), want.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// headerNames returns the names of the headers in either
+func headerNames(a, b http.Header) map[string]struct{} {
+	names := make(map[string]struct{})
+	for name := range a {
+		names[name] = struct{}{}
+	}
+	for name := range b {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+func TestNormalizeOrigin(t *testing.T) {
+	tests := map[string]string{
+		"https://Example.com":      "https://example.com",
+		"http://example.com:8080/": "http://example.com:8080",
+		"ftp://example.com":        "",
+		"https://example.com/page": "",
+		"https://user@example.com": "",
+		"example.com":              "",
+	}
+	for origin, want := range tests {
+		got, err := normalizeOrigin(origin)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("normalizeOrigin(%q) = %q, %v, want %q", origin, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+)
+
+const (
+	maxConnectBackoff = 30 * time.Second
+
+	// Once it's up, the database is pinged this often, so an outage is served degraded rather than as errors
+	databaseMonitorInterval = 5 * time.Second
+)
+
+// errDatabaseUnavailable is returned in place of querying a database that hasn't come up yet. Handlers
+// answer it with a 503 rather than a 500.
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+const (
+	migrateAuto   = "auto"
+	migrateVerify = "verify"
+	migrateOff    = "off"
+)
+
+// connectDatabase waits for the database to answer, then migrates it, or checks it was migrated, depending on
+// the migrate setting. A failed migration isn't retried, as trying again won't fix it. When it's to keep trying,
+// with zero attempts, a schema that isn't migrated yet is checked again until it is, see waitForSchema.
+func (app *application) connectDatabase(ctx context.Context, attempts int) error {
+	err := app.waitForDatabase(ctx, attempts)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case app.config.db.migrate == migrateAuto:
+		err = app.db.Migrate()
+	case app.config.db.migrate == migrateVerify && attempts == 0:
+		err = app.waitForSchema(ctx)
+	case app.config.db.migrate == migrateVerify:
+		err = app.verifySchema(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	app.dbReady.Store(true)
+	app.logger.Info("database ready")
+	return nil
+}
+
+// waitForDatabase tries to reach the database until it answers. Attempts back off exponentially, up to
+// maxConnectBackoff, and zero attempts means trying until ctx is cancelled.
+func (app *application) waitForDatabase(ctx context.Context, attempts int) error {
+	backoff := app.config.db.connectBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := app.db.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempts > 0 && attempt >= attempts {
+			return fmt.Errorf("unable to reach the database: %w", err)
+		}
+
+		app.logger.Warn("database unavailable", "attempt", attempt, "retry_in", backoff.String(), "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// waitForSchema checks the schema until it's been migrated, by a deploy step or another instance, backing off
+// like waitForDatabase until ctx is cancelled
+func (app *application) waitForSchema(ctx context.Context) error {
+	backoff := app.config.db.connectBackoff
+
+	for {
+		err := app.verifySchema(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		app.logger.Warn("database schema not ready", "retry_in", backoff.String(), "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// requireSchema waits for the database, and checks it's been migrated to the schema this build expects,
+// for commands that work with the data but leave migrating to the migrate command
+func (app *application) requireSchema(ctx context.Context) error {
+	err := app.waitForDatabase(ctx, app.config.db.connectAttempts)
+	if err != nil {
+		return err
+	}
+
+	err = app.verifySchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.dbReady.Store(true)
+	return nil
+}
+
+func (app *application) verifySchema(ctx context.Context) error {
+	version, expected, err := app.db.CheckSchema(ctx)
+	switch {
+	case errors.Is(err, database.ErrSchemaBehind):
+		return fmt.Errorf("the database schema is at version %d rather than %d, run migrate up", version, expected)
+	case errors.Is(err, database.ErrSchemaDirty):
+		return fmt.Errorf("the database schema is dirty at version %d, fix it and run migrate force", version)
+	case err != nil:
+		return err
+	case version > expected:
+		app.logger.Warn("the database schema is newer than this build", "version", version, "expected", expected)
+	}
+	return nil
+}
+
+// databaseReady reports whether the database is connected and migrated. It starts out false when the server
+// was started degraded, and goes back to false while the database doesn't answer, see monitorDatabase.
+func (app *application) databaseReady() bool {
+	return app.dbReady.Load()
+}
+
+// connectInBackground connects to the database for a server started degraded. Anything that fails is tried
+// again, backing off like waitForDatabase, as the database may still be migrated by someone else.
+func (app *application) connectInBackground(ctx context.Context) {
+	backoff := app.config.db.connectBackoff
+
+	for {
+		err := app.connectDatabase(ctx, 0)
+		if err == nil {
+			app.startDatabaseWorkers(ctx)
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		app.logger.Warn("database not ready", "retry_in", backoff.String(), "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// monitorDatabase pings the database every databaseMonitorInterval once it's ready, serving degraded while
+// it doesn't answer, and checks its schema while it does
+func (app *application) monitorDatabase(ctx context.Context) {
+	ticker := time.NewTicker(databaseMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := app.db.Ping(ctx)
+		switch {
+		case err != nil && app.dbReady.Swap(false):
+			app.logger.Warn("database unavailable, serving degraded", "error", err.Error())
+		case err == nil && !app.dbReady.Swap(true):
+			app.logger.Info("database available again")
+		}
+
+		// Kept up to date for the public /readyz, which doesn't query the database itself
+		if err == nil {
+			checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			app.checkSchema(checkCtx)
+			cancel()
+		}
+	}
+}
+
+// Clients are told to come back once the database has had a chance to come up
+var retryAfter = http.Header{"Retry-After": []string{"5"}}
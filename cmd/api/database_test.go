@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"openheart.tylery.com/internal/database"
+)
+
+// testDatabase connects to the database in TEST_DB_DSN, migrated, and skips the test if it isn't set
+func testDatabase(t *testing.T) *database.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN isn't set")
+	}
+
+	db, err := database.Open(dsn, database.PoolConfig{MaxOpenConns: 4, MaxIdleConns: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
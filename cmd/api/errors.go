@@ -1,12 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"openheart.tylery.com/internal/database"
 	"openheart.tylery.com/internal/response"
 	"openheart.tylery.com/internal/validator"
 )
@@ -19,12 +26,34 @@ func (app *application) reportServerError(r *http.Request, err error) {
 		trace   = string(debug.Stack())
 	)
 
+	span := oteltrace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, message)
+
 	requestAttrs := slog.Group("request", "method", method, "url", url)
-	app.logger.Error(message, requestAttrs, "trace", trace)
+	app.requestLogger(r).ErrorContext(r.Context(), message, requestAttrs, "trace", trace)
+}
+
+func (app *application) reportBackgroundError(name string, err error) {
+	var (
+		message = err.Error()
+		trace   = string(debug.Stack())
+	)
+
+	app.logger.Error(message, slog.Group("worker", "name", name), "trace", trace)
+}
+
+// capitalize uppercases the first letter of a message, which may be empty or start with any rune
+func capitalize(message string) string {
+	r, size := utf8.DecodeRuneInString(message)
+	if r == utf8.RuneError {
+		return message
+	}
+	return string(unicode.ToUpper(r)) + message[size:]
 }
 
 func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, status int, message string, headers http.Header) {
-	message = strings.ToUpper(message[:1]) + message[1:]
+	message = capitalize(message)
 
 	err := response.JSONWithHeaders(w, status, map[string]string{"Error": message}, headers)
 	if err != nil {
@@ -33,13 +62,37 @@ func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, sta
 	}
 }
 
+// The root protocol routes answer with short plain text bodies, which is what Open Heart clients expect
+func (app *application) protocolError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	err := response.Text(w, status, message)
+	if err != nil {
+		app.reportServerError(r, err)
+	}
+}
+
 func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	if app.isUnavailable(err) {
+		app.serviceUnavailable(w, r)
+		return
+	}
+
 	app.reportServerError(r, err)
 
 	message := "The server encountered a problem and could not process your request"
 	app.errorMessage(w, r, http.StatusInternalServerError, message, nil)
 }
 
+func (app *application) serviceUnavailable(w http.ResponseWriter, r *http.Request) {
+	message := "The database is unavailable, try again shortly"
+	app.errorMessage(w, r, http.StatusServiceUnavailable, message, retryAfter)
+}
+
+// isUnavailable reports whether a server error is down to the database not being up, which is answered with
+// a 503 and left unreported. Anything else that fails while degraded is a server error like any other.
+func (app *application) isUnavailable(err error) bool {
+	return errors.Is(err, errDatabaseUnavailable) || database.IsConnectionError(err)
+}
+
 func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
 	message := "The requested resource could not be found"
 	app.errorMessage(w, r, http.StatusNotFound, message, nil)
@@ -60,3 +113,128 @@ func (app *application) failedValidation(w http.ResponseWriter, r *http.Request,
 		app.serverError(w, r, err)
 	}
 }
+
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeInvalidUrl       = "invalid_url"
+	errCodeInvalidEmoji     = "invalid_emoji"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeNotAcceptable    = "not_acceptable"
+	errCodeFailedValidation = "failed_validation"
+	errCodeServerError      = "server_error"
+
+	errCodeRateLimited        = "rate_limited"
+	errCodeServiceUnavailable = "service_unavailable"
+)
+
+func (app *application) apiResponse(w http.ResponseWriter, r *http.Request, status int, data any, headers http.Header) {
+	err := response.Default.Render(w, r, status, envelope{Data: data}, headers)
+	if errors.Is(err, response.ErrNotAcceptable) {
+		app.apiNotAcceptable(w, r)
+		return
+	}
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+// apiNegotiate picks the format for an API response up front, for handlers whose caching headers depend on
+// it, answering 406 itself if there's none the client accepts
+func (app *application) apiNegotiate(w http.ResponseWriter, r *http.Request, data any) (response.Renderer, bool) {
+	response.AddVary(w.Header(), "Accept")
+
+	renderer, err := response.Default.Negotiate(r.Header.Get("Accept"), envelope{Data: data})
+	if err != nil {
+		app.apiNotAcceptable(w, r)
+		return nil, false
+	}
+	return renderer, true
+}
+
+// apiRender writes an API response in the format apiNegotiate picked
+func (app *application) apiRender(w http.ResponseWriter, r *http.Request, renderer response.Renderer, status int, data any, headers http.Header) {
+	err := response.Default.RenderWith(w, renderer, status, envelope{Data: data}, headers)
+	if err != nil {
+		app.apiServerError(w, r, err)
+	}
+}
+
+func (app *application) apiErrorMessage(w http.ResponseWriter, r *http.Request, status int, code string, message string, details any, headers http.Header) {
+	message = capitalize(message)
+
+	data := envelope{Error: &apiError{Code: code, Message: message, Details: details, RequestId: contextGetRequestId(r)}}
+	err := response.JSONWithHeaders(w, status, data, headers)
+	if err != nil {
+		app.reportServerError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (app *application) apiServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if app.isUnavailable(err) {
+		app.apiServiceUnavailable(w, r)
+		return
+	}
+
+	app.reportServerError(r, err)
+
+	message := "The server encountered a problem and could not process your request"
+	app.apiErrorMessage(w, r, http.StatusInternalServerError, errCodeServerError, message, nil, nil)
+}
+
+func (app *application) apiServiceUnavailable(w http.ResponseWriter, r *http.Request) {
+	message := "The database is unavailable, try again shortly"
+	app.apiErrorMessage(w, r, http.StatusServiceUnavailable, errCodeServiceUnavailable, message, nil, retryAfter)
+}
+
+func (app *application) apiRateLimited(w http.ResponseWriter, r *http.Request) {
+	message := "Too many reactions, slow down"
+	app.apiErrorMessage(w, r, http.StatusTooManyRequests, errCodeRateLimited, message, nil, nil)
+}
+
+func (app *application) apiUnauthorized(w http.ResponseWriter, r *http.Request) {
+	message := "A valid admin token is required for this resource"
+	headers := http.Header{"WWW-Authenticate": []string{"Bearer"}}
+	app.apiErrorMessage(w, r, http.StatusUnauthorized, errCodeUnauthorized, message, nil, headers)
+}
+
+func (app *application) apiForbidden(w http.ResponseWriter, r *http.Request, message string) {
+	app.apiErrorMessage(w, r, http.StatusForbidden, errCodeForbidden, message, nil, nil)
+}
+
+func (app *application) apiNotFound(w http.ResponseWriter, r *http.Request) {
+	message := "The requested resource could not be found"
+	app.apiErrorMessage(w, r, http.StatusNotFound, errCodeNotFound, message, nil, nil)
+}
+
+func (app *application) apiMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	message := fmt.Sprintf("The %s method is not supported for this resource", r.Method)
+	headers := http.Header{"Allow": []string{strings.Join(allowed, ", ")}}
+	app.apiErrorMessage(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message, nil, headers)
+}
+
+// Errors are always JSON, whatever the client accepts, so they aren't lost
+func (app *application) apiNotAcceptable(w http.ResponseWriter, r *http.Request) {
+	message := "The requested resource is not available in a format the Accept header allows"
+	app.apiErrorMessage(w, r, http.StatusNotAcceptable, errCodeNotAcceptable, message, nil, nil)
+}
+
+func (app *application) apiBadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	app.apiErrorMessage(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil, nil)
+}
+
+func (app *application) apiInvalidUrl(w http.ResponseWriter, r *http.Request, err error) {
+	app.apiErrorMessage(w, r, http.StatusBadRequest, errCodeInvalidUrl, err.Error(), nil, nil)
+}
+
+func (app *application) apiInvalidEmoji(w http.ResponseWriter, r *http.Request, err error) {
+	app.apiErrorMessage(w, r, http.StatusBadRequest, errCodeInvalidEmoji, err.Error(), nil, nil)
+}
+
+func (app *application) apiFailedValidation(w http.ResponseWriter, r *http.Request, v validator.Validator) {
+	message := "The request contains invalid values"
+	app.apiErrorMessage(w, r, http.StatusUnprocessableEntity, errCodeFailedValidation, message, v, nil)
+}
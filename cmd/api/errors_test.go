@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestCapitalize(t *testing.T) {
+	tests := map[string]string{
+		"":                  "",
+		"not found":         "Not found",
+		"Already":           "Already",
+		"évènement inconnu": "Évènement inconnu",
+		"💖 isn't allowed":   "💖 isn't allowed",
+		"\xffbad":           "\xffbad",
+	}
+	for message, want := range tests {
+		if got := capitalize(message); got != want {
+			t.Errorf("capitalize(%q) = %q, want %q", message, got, want)
+		}
+	}
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
 	"embed"
 	_ "embed"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/rivo/uniseg"
+	"html/template"
 	"io"
 	"net/http"
-	"net/url"
+
+	"openheart.tylery.com/internal/database"
 	"openheart.tylery.com/internal/request"
 	"openheart.tylery.com/internal/response"
+	"openheart.tylery.com/internal/version"
 )
 
 const maxPayloadByteSize = 64
@@ -40,44 +41,39 @@ func (app *application) getAll(w http.ResponseWriter, r *http.Request) {
 	}
 	parsedUrl, err := urlPathValue.Parse()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte("INVALID URL"))
+		app.protocolError(w, r, http.StatusBadRequest, "INVALID URL")
 		return
 	}
 
-	var urlId request.UrlIdColumn
-	var emojiRecords []request.EmojiTable
+	if wantsEventStream(r) {
+		app.stream(w, r)
+		return
+	}
 
-	// We look for the site id record. If none exists, we return 404
-	err = app.db.Get(&urlId, "SELECT id FROM site WHERE url=?", parsedUrl)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		app.serverError(w, r, err)
+	// We look for the all emoji's with this site. If none exists, we return 404
+	data, modified, err := app.counts(r.Context(), parsedUrl)
+	if errors.Is(err, database.ErrNotFound) {
+		app.protocolError(w, r, http.StatusNotFound, "NOT FOUND")
+		return
 	}
-	if errors.Is(err, sql.ErrNoRows) {
-		w.WriteHeader(http.StatusNotFound)
-		_, err = w.Write([]byte("NOT FOUND"))
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
-	// We look for the all emoji's with this site urlPathValue. If none exists, we return 404
-	err = app.db.Select(&emojiRecords, "SELECT id, site_id, emoji, count FROM emoji WHERE site_id=? ORDER BY count DESC", urlId)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	// Protocol clients predate negotiation, so an Accept we can't serve still gets JSON rather than a 406
+	renderer := response.Default.NegotiateOrDefault(r.Header.Get("Accept"), response.Counts(data))
+
+	notModified, err := app.notModified(w, r, renderer, data, modified)
+	if err != nil {
 		app.serverError(w, r, err)
-	}
-	if errors.Is(err, sql.ErrNoRows) {
-		w.WriteHeader(http.StatusNotFound)
-		_, err = w.Write([]byte("NOT FOUND"))
 		return
 	}
-
-	// We're not interested in revealing all information. We only return the emoji and the count for it
-	data := make(map[string]int, len(emojiRecords))
-	for i := range emojiRecords {
-		data[emojiRecords[i].Emoji.Decode()] = emojiRecords[i].Count
+	if notModified {
+		return
 	}
 
-	w.Header().Set("Cache-Control", "max-age=30")
-	err = response.JSON(w, http.StatusOK, data)
+	err = response.Default.RenderWith(w, renderer, http.StatusOK, response.Counts(data), nil)
 	if err != nil {
 		app.serverError(w, r, err)
 	}
@@ -85,133 +81,61 @@ func (app *application) getAll(w http.ResponseWriter, r *http.Request) {
 
 // Increment the count for a specific emoji by 1
 func (app *application) createOne(w http.ResponseWriter, r *http.Request) {
-	reader := io.LimitReader(r.Body, maxPayloadByteSize)
-	encodedValue := make([]byte, maxPayloadByteSize)
-	byteLength, err := reader.Read(encodedValue)
-	var emoji request.EmojiT
-
-	// Form submissions are url encoded, so we need to decode them before getting the
-	// key rune
-	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
-		escapedValue, err := url.QueryUnescape(string(encodedValue))
-		encodedValue, _, _, _ = uniseg.Step([]byte(escapedValue), -1)
-		if err != nil {
-			app.serverError(w, r, err)
-		}
-		emoji.Bytes = encodedValue
-
-		// JSON has a specific structure {"emoji": "🌾"}
-		// So, we need to convert it to this structure first. Then we parse it
-	} else if r.Header.Get("Content-Type") == "application/json" {
-		var jInput = struct {
-			Emoji string `json:"emoji"`
-		}{}
-		err = json.Unmarshal(encodedValue[:byteLength], &jInput)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, err = w.Write([]byte("BAD REQUEST"))
-			return
-		}
-
-		encodedValue, _, _, _ = uniseg.Step([]byte(jInput.Emoji), -1)
-		emoji.Bytes = encodedValue
-
-		//	For all other requests, we try to decode the string and get the first rune.
-	} else {
-		encodedValue, _, _, _ = uniseg.Step(encodedValue, -1)
-		emoji.Bytes = encodedValue
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadByteSize))
+	if err != nil {
+		app.rejectReaction(errCodeBadRequest)
+		app.protocolError(w, r, http.StatusBadRequest, "BAD REQUEST")
+		return
 	}
 
-	// Let's see if the first rune is an emoji
-	emojiRunes, err := emoji.ParseRunes()
-	if emojiRunes[0] == 0 || err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte("BAD REQUEST"))
+	emoji, err := request.ParseEmoji(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		if errors.Is(err, request.ErrBadJSON) {
+			app.rejectReaction(errCodeBadRequest)
+		} else {
+			app.rejectReaction(errCodeInvalidEmoji)
+		}
+		app.protocolError(w, r, http.StatusBadRequest, "BAD REQUEST")
 		return
 	}
 
 	urlPathValue := request.InputUrl(r.PathValue("url"))
 	parsedUrl, err := urlPathValue.Parse()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte("INVALID URL"))
+		app.rejectReaction(errCodeInvalidUrl)
+		app.protocolError(w, r, http.StatusBadRequest, "INVALID URL")
 		return
 	}
-	var urlId request.UrlIdColumn
-
-	var emojiRecord request.EmojiTable
 
-	// First, we get the site id based on the url. We should probably try to parse the url to try and only get
-	// relevant data.
-	err = app.db.Get(&urlId, "SELECT id FROM site WHERE url=?", parsedUrl)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		app.serverError(w, r, err)
-	}
-	var noSiteRecord bool
-	var noEmojiRecord bool
-	if urlId == 0 {
-		noSiteRecord = true
-		noEmojiRecord = true
-	} else {
-		// Next, we get the emoji count for this specific url. It might not exist! We need to check for this and create a new one
-		// if this is the case
-		err = app.db.Get(&emojiRecord, "SELECT id, site_id, emoji, count FROM emoji WHERE site_id=? AND emoji=?", urlId, emoji.DbEncode())
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			app.serverError(w, r, err)
-		}
-		if emojiRecord.Id == 0 {
-			noEmojiRecord = true
-		}
-	}
-
-	// With an existing, we need to update the value by incrementing by one. If it doesn't exist, creating the record
-	// starts the count at 1, so we're good.
-	tx := app.db.MustBegin()
-	defer tx.Rollback()
-	if noSiteRecord {
-		tx.MustExec("INSERT INTO site (url) VALUES (?)", urlPathValue)
-		err := tx.Get(&urlId, "SELECT id FROM site WHERE url=?", urlPathValue)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			app.serverError(w, r, err)
-		}
-	}
-	if noEmojiRecord {
-		tx.MustExec("INSERT INTO emoji (site_id, emoji) VALUES (?, ?)", urlId, emoji.DbEncode())
-	} else {
-		updateStmt, _ := tx.Prepare("UPDATE emoji SET count=? WHERE id=?")
-		_, err = updateStmt.Exec(emojiRecord.Count+1, emojiRecord.Id)
-		if err != nil {
-			tx.Rollback()
-		}
+	count, created, err := app.addReaction(r, parsedUrl, emoji)
+	if errors.Is(err, errBlocked) {
+		app.protocolError(w, r, http.StatusForbidden, "FORBIDDEN")
+		return
 	}
-
-	// If Accept header is included, we will return the count in that format. Currently only json
-	respondCount := r.Header.Get("Accept") == "application/json"
-
-	if respondCount {
-		err = tx.Get(&emojiRecord, "SELECT id, site_id, emoji, count FROM emoji WHERE site_id=? AND emoji=?", urlId, emoji.DbEncode())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
-	tx.Commit()
 
-	app.logger.Info(fmt.Sprintf("%s -> %s reaction!", urlPathValue, emoji.String()))
 	var status int
-	if noEmojiRecord == true {
+	if created {
 		status = http.StatusCreated
 	} else {
 		status = http.StatusOK
 	}
-	if respondCount {
-		if r.Header.Get("Accept") == "application/json" {
-			data := map[string]int{
-				emojiRecord.Emoji.Decode(): emojiRecord.Count,
-			}
-			err = response.JSONWithHeaders(w, status, data, http.Header{
-				"Cache-Control": []string{"max-age=30"},
-			})
+
+	// If Accept header is included, we will return the count in that format. Currently only json
+	if r.Header.Get("Accept") == "application/json" {
+		data := map[string]int{
+			emoji.String(): count,
 		}
+		err = response.JSONWithHeaders(w, status, data, http.Header{
+			"Cache-Control": []string{app.cacheControl()},
+		})
 	} else {
-		w.Header().Set("Cache-Control", "max-age=30")
-		_, err = w.Write([]byte("OK"))
+		err = response.TextWithHeaders(w, status, "OK", http.Header{
+			"Cache-Control": []string{app.cacheControl()},
+		})
 	}
 	if err != nil {
 		app.serverError(w, r, err)
@@ -221,17 +145,61 @@ func (app *application) createOne(w http.ResponseWriter, r *http.Request) {
 //go:embed templates/home.html
 var homeHtml embed.FS
 
+// parseHomeTemplate parses the home page once, on startup, as it's embedded and never changes
+func parseHomeTemplate() (*template.Template, error) {
+	tmpl, err := template.ParseFS(homeHtml, "templates/home.html")
+	if err != nil {
+		return nil, fmt.Errorf("error reading template: %w", err)
+	}
+	return tmpl, nil
+}
+
 func (app *application) homePage(w http.ResponseWriter, r *http.Request) {
-	content, err := homeHtml.ReadFile("templates/home.html")
+	// The page loads the widget by version, so a deploy is picked up straight away
+	data := map[string]string{
+		"WidgetVersion": version.Get(),
+	}
 
+	var content bytes.Buffer
+	err := app.homeTemplate.Execute(&content, data)
 	if err != nil {
-		app.serverError(w, r, fmt.Errorf("error reading template: %v", err))
+		app.serverError(w, r, fmt.Errorf("error rendering template: %v", err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(content)
+	_, err = w.Write(content.Bytes())
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+//go:embed static/widget.js
+var widgetJs []byte
+
+// widget serves the <open-heart> web component. The ETag is the build version, and a request with the same
+// version in its v parameter may be cached for good, as any other build serves it from a different URL.
+func (app *application) widget(w http.ResponseWriter, r *http.Request) {
+	currentVersion := version.Get()
+	etag := fmt.Sprintf(`"%s"`, currentVersion)
+
+	if currentVersion != "unavailable" && r.URL.Query().Get("v") == currentVersion {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(widgetJs)
 	if err != nil {
 		app.serverError(w, r, err)
 	}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"openheart.tylery.com/internal/version"
+)
+
+func TestHomePage(t *testing.T) {
+	tmpl, err := parseHomeTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{homeTemplate: tmpl}
+
+	// Rendered from the one template every time
+	for range 2 {
+		w := httptest.NewRecorder()
+		app.homePage(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if !strings.Contains(w.Body.String(), `src="/widget.js?v=`+version.Get()+`"`) {
+			t.Error("the page doesn't load the widget by version")
+		}
+	}
+}
+
+// Each format of the counts has its own ETag, so a copy of one is never revalidated as another
+func TestGetAllETagByFormat(t *testing.T) {
+	app := newDegradedApp()
+	app.settings.Store(&settings{cacheMaxAge: time.Minute})
+	app.countsCache.Load("example.com", func() (cachedCounts, error) {
+		return cachedCounts{counts: map[string]int{"💖": 3}}, nil
+	})
+
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/example.com", nil)
+		r.SetPathValue("url", "example.com")
+		r.Header.Set("Accept", accept)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		app.getAll(w, r)
+		return w
+	}
+
+	json := get("application/json", "")
+	csv := get("text/csv", "")
+	if json.Code != http.StatusOK || csv.Code != http.StatusOK {
+		t.Fatalf("status = %d and %d, want %d", json.Code, csv.Code, http.StatusOK)
+	}
+	jsonTag, csvTag := json.Header().Get("ETag"), csv.Header().Get("ETag")
+	if jsonTag == "" || jsonTag == csvTag {
+		t.Errorf("JSON is tagged %q and CSV %q, want different tags", jsonTag, csvTag)
+	}
+
+	if w := get("text/csv", jsonTag); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("CSV with the JSON tag = %d %s, want the CSV", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w := get("text/csv", csvTag); w.Code != http.StatusNotModified {
+		t.Errorf("CSV with its own tag = %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if got := json.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept" {
+		t.Errorf("Vary = %q, want Accept once", got)
+	}
+}
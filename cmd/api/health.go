@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/response"
+)
+
+const readinessTimeout = time.Second
+
+const (
+	checkOK      = "ok"
+	checkFailing = "failing"
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type migrationCheck struct {
+	healthCheck
+	Version  uint `json:"version"`
+	Expected uint `json:"expected"`
+	Dirty    bool `json:"dirty"`
+}
+
+// Reactions waiting to be written out to webhooks. A backlog is reported, but doesn't make us unready, as
+// another instance can't do anything about it.
+type webhookCheck struct {
+	healthCheck
+	Batched int `json:"batched"`
+	Pending int `json:"pending"`
+}
+
+// healthz reports that the process is alive and serving requests, whatever the state of its dependencies
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	err := response.JSON(w, http.StatusOK, map[string]string{"status": "OK"})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// readyz reports whether we should be sent traffic: the database answers and is migrated, and we aren't
+// shutting down. As it's public, it answers from what the database monitor last found rather than querying
+// the database, and only gets the status, as the checks' errors can name hosts and schema details. The
+// admin port runs every check, see readyzDetailed.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	status, data := http.StatusOK, map[string]any{"status": "ready"}
+	if app.shuttingDown.Load() || !app.databaseReady() || app.schemaFailing.Load() {
+		status, data = http.StatusServiceUnavailable, map[string]any{"status": "not ready"}
+	}
+
+	app.writeReadiness(w, r, status, data)
+}
+
+func (app *application) readyzDetailed(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	ready := !app.shuttingDown.Load()
+
+	db := healthCheck{Status: checkOK}
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		ready = false
+		db = healthCheck{Status: checkFailing, Error: err.Error()}
+	}
+
+	migrations := app.checkSchema(ctx)
+	if migrations.Status != checkOK {
+		ready = false
+	}
+
+	webhooks := webhookCheck{healthCheck: healthCheck{Status: checkOK}, Batched: app.webhooks.size()}
+	webhooks.Pending, err = app.db.PendingWebhookDeliveries(ctx)
+	if err != nil {
+		webhooks.healthCheck = healthCheck{Status: checkFailing, Error: err.Error()}
+	}
+
+	data := map[string]any{
+		"status":        "ready",
+		"shutting_down": app.shuttingDown.Load(),
+		"checks": map[string]any{
+			"database":   db,
+			"migrations": migrations,
+			"webhooks":   webhooks,
+		},
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		data["status"] = "not ready"
+	}
+
+	app.writeReadiness(w, r, status, data)
+}
+
+// checkSchema checks the database is migrated to the schema this build expects, and remembers whether it is
+// for the public /readyz
+func (app *application) checkSchema(ctx context.Context) migrationCheck {
+	check := migrationCheck{healthCheck: healthCheck{Status: checkOK}}
+
+	var err error
+	check.Version, check.Expected, err = app.db.CheckSchema(ctx)
+	app.schemaFailing.Store(err != nil)
+	if err != nil {
+		check.Dirty = errors.Is(err, database.ErrSchemaDirty)
+		check.healthCheck = healthCheck{Status: checkFailing, Error: err.Error()}
+	}
+	return check
+}
+
+func (app *application) writeReadiness(w http.ResponseWriter, r *http.Request, status int, data map[string]any) {
+	// Probes want the current state, never a cached one
+	err := response.JSONWithHeaders(w, status, data, http.Header{"Cache-Control": []string{"no-store"}})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
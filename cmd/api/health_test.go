@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The public /readyz answers from the state the server keeps, without a database to query
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		dbReady, schemaFailing, shuttingDown bool
+		want                                 int
+	}{
+		{name: "ready", dbReady: true, want: http.StatusOK},
+		{name: "database down", want: http.StatusServiceUnavailable},
+		{name: "schema failing", dbReady: true, schemaFailing: true, want: http.StatusServiceUnavailable},
+		{name: "shutting down", dbReady: true, shuttingDown: true, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			app.dbReady.Store(tt.dbReady)
+			app.schemaFailing.Store(tt.schemaFailing)
+			app.shuttingDown.Store(tt.shuttingDown)
+
+			rec := httptest.NewRecorder()
+			app.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("readyz = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"time"
+
+	"openheart.tylery.com/internal/response"
 )
 
 func (app *application) backgroundTask(r *http.Request, fn func() error) {
 	app.wg.Add(1)
+	app.background.Add(1)
 
 	go func() {
 		defer app.wg.Done()
+		defer app.background.Add(-1)
 
 		defer func() {
 			err := recover()
@@ -24,3 +30,45 @@ func (app *application) backgroundTask(r *http.Request, fn func() error) {
 		}
 	}()
 }
+
+// backgroundWorker runs fn on its own goroutine for as long as it takes. Like backgroundTask, shutdown waits
+// for it through app.wg, so fn should return soon after ctx is cancelled.
+func (app *application) backgroundWorker(ctx context.Context, name string, fn func(ctx context.Context)) {
+	app.wg.Add(1)
+	app.background.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+		defer app.background.Add(-1)
+
+		defer func() {
+			err := recover()
+			if err != nil {
+				app.reportBackgroundError(name, fmt.Errorf("%s", err))
+			}
+		}()
+
+		fn(ctx)
+	}()
+}
+
+func (app *application) cacheControl() string {
+	return fmt.Sprintf("max-age=%d", int(app.currentSettings().cacheMaxAge.Seconds()))
+}
+
+// notModified sets the caching headers for count data in the format a renderer was negotiated for, and
+// answers 304 if the client's copy is still fresh. Handlers return straight away when it reports true.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, renderer response.Renderer, data any, lastModified time.Time) (bool, error) {
+	// Each format gets its own tag, or a cache holding the JSON could answer a request for CSV with it
+	etag, err := response.WeakETag(struct {
+		ContentType string
+		Data        any
+	}{renderer.ContentType(), data})
+	if err != nil {
+		return false, err
+	}
+
+	w.Header().Set("Cache-Control", app.cacheControl())
+	response.AddVary(w.Header(), "Accept")
+	return response.NotModified(w, r, etag, lastModified), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+)
+
+// countsFile is the counts of a url, in the format every Open Heart implementation answers a GET with
+type countsFile struct {
+	url  string
+	path string
+}
+
+// importCounts is the import-counts command, which imports the counts other Open Heart implementations serve,
+// {"❤️": 3, "👍": 1}, for a single url or every url in a manifest:
+//
+//	{"example.com": "example.com.json", "example.com/blog/post.html": "counts/post.json"}
+//
+// Urls and emoji are held to the rules reactions are. Counts that end up on the same site and emoji are
+// added up before they're merged, as they would have been if the reactions had been made here.
+func (app *application) importCounts() error {
+	ctx := context.Background()
+	merge, err := app.importMerge()
+	if err != nil {
+		return err
+	}
+
+	// Everything read identifies the import, so running it again doesn't write it twice
+	hash := sha256.New()
+	var files []countsFile
+	switch url, manifest := app.config.importing.url, app.config.importing.manifest; {
+	case url != "" && manifest == "" && len(app.config.args) == 1:
+		files = []countsFile{{url: url, path: app.config.args[0]}}
+		hash.Write([]byte(url))
+	case url == "" && manifest != "" && len(app.config.args) == 0:
+		var data []byte
+		files, data, err = readManifest(manifest)
+		if err != nil {
+			return err
+		}
+		hash.Write(data)
+	default:
+		return fmt.Errorf("import-counts needs either -url and a counts file, or -manifest, see %s import-counts -h", programName)
+	}
+
+	sites, total, err := app.readCounts(files, hash)
+	if err != nil {
+		return err
+	}
+
+	err = app.requireSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	im := app.newImporter(ctx, hex.EncodeToString(hash.Sum(nil)), merge, total)
+	for _, siteUrl := range slices.Sorted(maps.Keys(sites)) {
+		if len(sites[siteUrl]) == 0 {
+			continue
+		}
+		err = im.add(importRecord{site: &database.SiteCounts{Url: siteUrl, Counts: sites[siteUrl]}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return im.finish()
+}
+
+// readCounts reads the counts in every file, by the site and emoji they'd be stored as, adding up those that
+// end up on the same ones. Everything read is written to hash. It also returns how many counts there are.
+func (app *application) readCounts(files []countsFile, hash io.Writer) (map[string]map[string]int, int, error) {
+	sites := map[string]map[string]int{}
+	var total int
+	for _, file := range files {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return nil, 0, err
+		}
+		hash.Write(data)
+
+		siteUrl, err := request.InputUrl(file.url).Parse()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %q is not a valid url", file.path, file.url)
+		}
+
+		var counts map[string]int
+		err = json.Unmarshal(data, &counts)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", file.path, err)
+		}
+
+		if sites[siteUrl] == nil {
+			sites[siteUrl] = map[string]int{}
+		}
+		for key, count := range counts {
+			emoji, err := request.ParseEmoji("text/plain", []byte(key))
+			if err != nil || count < 0 {
+				app.logger.Warn("skipping a count that isn't of an emoji", "file", file.path, "emoji", key, "count", count)
+				continue
+			}
+			if _, found := sites[siteUrl][emoji.String()]; !found {
+				total++
+			}
+			sites[siteUrl][emoji.String()] += count
+		}
+	}
+	return sites, total, nil
+}
+
+// readManifest reads a manifest of urls and the files with their counts, which are relative to the manifest.
+// It returns them in order of url, along with the manifest itself.
+func readManifest(path string) ([]countsFile, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest map[string]string
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(manifest) == 0 {
+		return nil, nil, errors.New("the manifest has no urls")
+	}
+
+	var files []countsFile
+	for _, url := range slices.Sorted(maps.Keys(manifest)) {
+		file := manifest[url]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		files = append(files, countsFile{url: url, path: file})
+	}
+	return files, data, nil
+}
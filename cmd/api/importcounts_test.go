@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file under dir, creating the directories it's in
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	absolute := writeFile(t, dir, "elsewhere/a.json", "{}")
+	content := fmt.Sprintf(`{"b.com": "counts/b.json", "a.com": %q}`, absolute)
+	manifest := writeFile(t, dir, "import/manifest.json", content)
+
+	files, data, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In order of url, with relative paths resolved against the manifest's directory rather than ours
+	want := []countsFile{
+		{url: "a.com", path: absolute},
+		{url: "b.com", path: filepath.Join(dir, "import", "counts", "b.json")},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("readManifest = %+v, want %+v", files, want)
+	}
+	if string(data) != content {
+		t.Errorf("readManifest returned %q as the manifest, want %q", data, content)
+	}
+
+	for name, content := range map[string]string{"empty": "{}", "not json": "example.com", "not paths": `{"a.com": 1}`} {
+		_, _, err := readManifest(writeFile(t, dir, name+".json", content))
+		if err == nil {
+			t.Errorf("read a manifest that's %s", name)
+		}
+	}
+	if _, _, err := readManifest(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("read a manifest that doesn't exist")
+	}
+}
+
+func TestReadCounts(t *testing.T) {
+	dir := t.TempDir()
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	contents := []string{
+		`{"❤️": 2, "👍🏽 thanks": 1, "love": 5}`,
+		`{"❤️": 3, "👍🏽": 4, "🎉": -1}`,
+		`{}`,
+	}
+	files := []countsFile{
+		{url: "example.com", path: writeFile(t, dir, "one.json", contents[0])},
+		{url: "https://example.com", path: writeFile(t, dir, "two.json", contents[1])},
+		{url: "other.org", path: writeFile(t, dir, "three.json", contents[2])},
+	}
+
+	var hash bytes.Buffer
+	sites, total, err := app.readCounts(files, &hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both urls are the one site, keys are cut down to their emoji, and what ends up on the same emoji is added
+	// up. Keys without an emoji and negative counts are left out.
+	want := map[string]map[string]int{
+		"example.com": {"❤️": 5, "👍🏽": 5},
+		"other.org":   {},
+	}
+	if !reflect.DeepEqual(sites, want) || total != 2 {
+		t.Errorf("readCounts = %v, %d, want %v, 2", sites, total, want)
+	}
+	if hash.String() != contents[0]+contents[1]+contents[2] {
+		t.Errorf("hashed %q, want every file", hash.String())
+	}
+
+	for name, file := range map[string]countsFile{
+		"bad url":  {url: "not a url", path: files[0].path},
+		"bad json": {url: "example.com", path: writeFile(t, dir, "bad.json", `{"❤️": "three"}`)},
+		"missing":  {url: "example.com", path: filepath.Join(dir, "missing.json")},
+	} {
+		if _, _, err := app.readCounts([]countsFile{file}, io.Discard); err == nil {
+			t.Errorf("read counts with a %s", name)
+		}
+	}
+}
+
+// A manifest is imported into the counts, and importing it again doesn't add to them
+func TestImportCounts(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	started := time.Now().Add(-time.Second)
+
+	site := fmt.Sprintf("import-counts-%d.test", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.ExecContext(ctx, "DELETE FROM site WHERE url=?", site)
+		db.ExecContext(ctx, "DELETE FROM import_batch WHERE created_at >= FROM_UNIXTIME(?)", started.Unix())
+	})
+
+	dir := t.TempDir()
+	writeFile(t, dir, "counts/one.json", `{"❤️": 2, "👍": 1}`)
+	writeFile(t, dir, "counts/two.json", `{"❤️": 3}`)
+	manifest := writeFile(t, dir, "manifest.json", fmt.Sprintf(`{%q: "counts/one.json", "https://%s": "counts/two.json"}`, site, site))
+
+	app := &application{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app.config.db.connectAttempts = 1
+	app.config.importing.merge = "sum"
+	app.config.importing.batchSize = 1
+	app.config.importing.manifest = manifest
+
+	for run := 1; run <= 2; run++ {
+		err := app.importCounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts, err := db.Counts(ctx, site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"❤️": 5, "👍": 1}; !reflect.DeepEqual(counts, want) {
+			t.Errorf("counts after run %d = %v, want %v", run, counts, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"openheart.tylery.com/internal/listen"
+)
+
+type listeners struct {
+	public   net.Listener
+	admin    net.Listener // nil when there's no admin server
+	redirect net.Listener // nil when there's no redirect server
+}
+
+// openListeners takes the listeners passed by systemd socket activation, or by the process this one replaces,
+// matched to servers by their FileDescriptorName: admin, redirect, and anything else for the public server.
+// Servers without one listen on their configured Unix socket or port.
+func (app *application) openListeners(tls bool) (_ listeners, err error) {
+	var ls listeners
+	defer func() {
+		if err != nil {
+			ls.close()
+		}
+	}()
+
+	inherited, err := listen.Systemd()
+	if err != nil {
+		return ls, err
+	}
+	handedOff, err := listen.Handoff()
+	if err != nil {
+		return ls, err
+	}
+	inherited = append(inherited, handedOff...)
+
+	for _, l := range inherited {
+		switch {
+		case l.Name == "admin" && ls.admin == nil:
+			ls.admin = l.Listener
+		case l.Name == "redirect" && ls.redirect == nil && tls:
+			ls.redirect = l.Listener
+		case l.Name != "admin" && l.Name != "redirect" && ls.public == nil:
+			ls.public = l.Listener
+		default:
+			app.logger.Warn("ignoring inherited listener", "name", l.Name, "addr", l.Listener.Addr().String())
+			l.Listener.Close()
+		}
+	}
+
+	if ls.public == nil {
+		if app.config.unixSocket.path != "" {
+			ls.public, err = listen.Unix(app.config.unixSocket.path, app.config.unixSocket.fileMode)
+		} else {
+			ls.public, err = net.Listen("tcp", fmt.Sprintf(":%d", app.config.httpPort))
+		}
+		if err != nil {
+			return ls, err
+		}
+	}
+
+	if ls.admin == nil && app.config.adminPort != 0 {
+		ls.admin, err = net.Listen("tcp", fmt.Sprintf(":%d", app.config.adminPort))
+		if err != nil {
+			return ls, err
+		}
+	}
+
+	if ls.redirect == nil && tls && app.config.tls.redirectPort != 0 {
+		ls.redirect, err = net.Listen("tcp", fmt.Sprintf(":%d", app.config.tls.redirectPort))
+		if err != nil {
+			return ls, err
+		}
+	}
+
+	ls.public = newStoppableListener(ls.public)
+	if ls.admin != nil {
+		ls.admin = newStoppableListener(ls.admin)
+	}
+	if ls.redirect != nil {
+		ls.redirect = newStoppableListener(ls.redirect)
+	}
+
+	return ls, nil
+}
+
+// inherited names the listeners the way openListeners matches them, for passing them on
+func (ls listeners) inherited() []listen.Inherited {
+	inherited := []listen.Inherited{{Name: "http", Listener: unwrapListener(ls.public)}}
+	if ls.admin != nil {
+		inherited = append(inherited, listen.Inherited{Name: "admin", Listener: unwrapListener(ls.admin)})
+	}
+	if ls.redirect != nil {
+		inherited = append(inherited, listen.Inherited{Name: "redirect", Listener: unwrapListener(ls.redirect)})
+	}
+	return inherited
+}
+
+// stop stops accepting connections, without the servers noticing until they shut down
+func (ls listeners) stop() {
+	for _, l := range []net.Listener{ls.public, ls.admin, ls.redirect} {
+		if l, ok := l.(*stoppableListener); ok {
+			l.stop()
+		}
+	}
+}
+
+func (ls listeners) close() error {
+	var err error
+	for _, l := range []net.Listener{ls.public, ls.admin, ls.redirect} {
+		if l != nil {
+			err = errors.Join(err, l.Close())
+		}
+	}
+	return err
+}
+
+// stoppableListener can stop accepting connections once another process has taken over its socket. Closing
+// it under the server would make Serve fail, so Accept waits for the server to close it instead.
+type stoppableListener struct {
+	net.Listener
+	stopped   atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStoppableListener(l net.Listener) *stoppableListener {
+	return &stoppableListener{Listener: l, closed: make(chan struct{})}
+}
+
+func (l *stoppableListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil && l.stopped.Load() {
+		<-l.closed
+		return nil, net.ErrClosed
+	}
+	return conn, err
+}
+
+func (l *stoppableListener) stop() {
+	l.stopped.Store(true)
+	l.Listener.Close()
+}
+
+func (l *stoppableListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		if !l.stopped.Load() {
+			err = l.Listener.Close()
+		}
+	})
+	return err
+}
+
+func unwrapListener(l net.Listener) net.Listener {
+	if l, ok := l.(*stoppableListener); ok {
+		return l.Listener
+	}
+	return l
+}
+
+// proxiedClient takes the client's address from the proxy in front for requests over a Unix socket, which
+// can only have come from a local proxy and have no address of their own. Without it, rate limits and
+// blocklists would see every client as the same one.
+func proxiedClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if ok && localAddr.Network() == "unix" {
+			if addr, ok := forwardedFor(r); ok {
+				r.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor prefers X-Real-IP, and otherwise takes the last X-Forwarded-For address, which is the one the
+// proxy added rather than one the client claims
+func forwardedFor(r *http.Request) (netip.Addr, bool) {
+	value := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if value == "" {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) == 0 {
+			return netip.Addr{}, false
+		}
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		value = strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
@@ -1,23 +1,39 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"html/template"
+	"io/fs"
 	"log/slog"
-	"openheart.tylery.com/internal/env"
+	"net/netip"
 	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"openheart.tylery.com/internal/cache"
+	"openheart.tylery.com/internal/certs"
 	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/pubsub"
+	"openheart.tylery.com/internal/tracing"
 	"openheart.tylery.com/internal/version"
 )
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	// Commands other than serve keep stdout for their output
+	logOutput := os.Stdout
+	if name, _ := splitCommand(os.Args); name != "serve" {
+		logOutput = os.Stderr
+	}
+
+	logLevel := new(slog.LevelVar)
+	logger := slog.New(tracing.NewLogHandler(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: logLevel})))
 
-	err := run(logger)
+	err := run(logger, logLevel)
 	if err != nil {
 		trace := string(debug.Stack())
 		logger.Error(err.Error(), "trace", trace)
@@ -26,67 +42,190 @@ func main() {
 }
 
 type config struct {
-	httpPort int
-	db       struct {
-		dsn string
-	}
-}
+	httpPort   int
+	unixSocket struct {
+		path string
+		mode string
 
-type application struct {
-	config config
-	db     *database.DB
-	logger *slog.Logger
-	wg     sync.WaitGroup
-}
-
-func run(logger *slog.Logger) error {
-	var cfg config
-
-	// The intent for config here is to allow environment variables, however if they do it inline it is overridden
-	// by inline flags
-	var httpPort int
-	var dsn string
+		fileMode fs.FileMode
+	}
+	adminPort      int
+	adminToken     string
+	drainDelay     time.Duration
+	restartTimeout time.Duration
+	server         struct {
+		idleTimeout     time.Duration
+		readTimeout     time.Duration
+		writeTimeout    time.Duration
+		shutdownTimeout time.Duration
+		http2           bool
+	}
+	tls struct {
+		certFiles    string
+		keyFiles     string
+		redirectPort int
+		publicPort   int
 
-	flag.IntVar(&httpPort, "http-port", 0, "Default 4444")
-	flag.StringVar(&dsn, "dsn", "", "Database DSN (default user:password@tcp(host:port)/database)")
+		pairs []certs.Pair
+	}
+	tracing struct {
+		exporter string
+		file     string
+	}
+	cacheMaxAge     time.Duration
+	recordReactions bool
+	db              struct {
+		dsn             string
+		connectAttempts int
+		connectBackoff  time.Duration
+		startDegraded   bool
+		migrate         string
+		pool            database.PoolConfig
+	}
+	prune struct {
+		interval     time.Duration
+		idleDays     int
+		maxReactions int
+		archive      bool
+		compactDays  int
+		dryRun       bool
+	}
+	webhooks struct {
+		workers      int
+		allowPrivate bool
+	}
+	countsCache struct {
+		size int
+		ttl  time.Duration
+	}
+	rateLimit struct {
+		rps   float64
+		burst int
+	}
+	logLevel string
+	blocked  struct {
+		clients string
+		sites   string
 
-	if httpPort != 0 {
-		cfg.httpPort = httpPort
-	} else {
-		cfg.httpPort = env.GetInt("HTTP_PORT", 4444)
+		clientPrefixes []netip.Prefix
+		siteUrls       []string
 	}
+	cors struct {
+		origins string
 
-	if dsn != "" {
-		cfg.db.dsn = dsn
-	} else {
-		cfg.db.dsn = env.GetString("DB_DSN", "user:pass@localhost:3306/db")
+		originList []string
+	}
+	export struct {
+		output    string
+		format    string
+		reactions bool
+	}
+	importing struct {
+		format    string
+		merge     string
+		batchSize int
+		url       string // Of the counts file import-counts reads
+		manifest  string
+	}
+	stats struct {
+		limit int
 	}
 
-	showVersion := flag.Bool("version", false, "display version and exit")
+	command string
+	args    []string          // What's left after the command's flags
+	values  map[string]string // Every setting as set, by flag name, for comparing reloads
+}
 
-	flag.Parse()
+type application struct {
+	config   config
+	db       *database.DB
+	hub      *pubsub.Hub
+	webhooks *webhookBatch
+	logger   *slog.Logger
+
+	homeTemplate *template.Template
+
+	countsCache *cache.Cache[cachedCounts] // nil when disabled
+	// Each site's own allowed origins, which CORS checks on every request with an Origin. Sized and expired
+	// like the counts cache, and nil when it's disabled.
+	originsCache *cache.Cache[[]string]
+	rateLimiter  *rateLimiter
+	settings     atomic.Pointer[settings] // Swapped on SIGHUP, see reloadConfig
+	logLevel     *slog.LevelVar
+	metrics      *metrics
+	background   atomic.Int64 // What wg is waiting for, as a WaitGroup can't report it
+
+	dbReady       atomic.Bool // Connected and migrated, see databaseReady
+	schemaFailing atomic.Bool // The last schema check failed, see checkSchema
+	shuttingDown  atomic.Bool
+	wg            sync.WaitGroup
+}
 
-	if *showVersion {
+func run(logger *slog.Logger, logLevel *slog.LevelVar) error {
+	// These two don't need any configuration, so a broken one doesn't get in their way
+	switch name, _ := splitCommand(os.Args); name {
+	case "help":
+		printCommands(os.Stdout)
+		return nil
+	case "version":
 		fmt.Printf("version: %s\n", version.Get())
 		return nil
 	}
 
-	db, err := database.New(cfg.db.dsn)
+	cfg, err := loadConfig(os.Args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_ = logLevel.UnmarshalText([]byte(cfg.logLevel))
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.tracing.exporter, cfg.tracing.file, "openheart-protocol", version.Get())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			logger.Error("unable to flush traces", "error", err.Error())
+		}
+	}()
+
+	db, err := database.Open(cfg.db.dsn, cfg.db.pool)
 	if err != nil {
 		return err
 	}
 	defer func(db *database.DB) {
 		err := db.Close()
 		if err != nil {
-			log.Fatalln("unable to close db connection!")
+			logger.Error("unable to close db connection", "error", err.Error())
 		}
 	}(db)
 
 	app := application{
-		config: cfg,
-		db:     db,
-		logger: logger,
+		config:   cfg,
+		db:       db,
+		hub:      pubsub.New(defaultStreamHistory),
+		webhooks: newWebhookBatch(),
+		logger:   logger,
+		logLevel: logLevel,
+	}
+	app.settings.Store(newSettings(cfg))
+
+	app.homeTemplate, err = parseHomeTemplate()
+	if err != nil {
+		return err
+	}
+
+	if cfg.countsCache.size > 0 {
+		app.countsCache = cache.New[cachedCounts](cfg.countsCache.size, cfg.countsCache.ttl)
+		app.originsCache = cache.New[[]string](cfg.countsCache.size, cfg.countsCache.ttl)
 	}
+	app.rateLimiter = newRateLimiter(cfg.rateLimit.rps, cfg.rateLimit.burst)
+	app.metrics = app.newMetrics()
 
-	return app.serveHTTP()
+	cmd, _ := findCommand(cfg.command)
+	return cmd.run(&app)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"openheart.tylery.com/internal/version"
+)
+
+const (
+	metricsNamespace = "openheart"
+	reactionAccepted = "accepted"
+	reactionRejected = "rejected"
+)
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	reactions       *prometheus.CounterVec
+}
+
+// newMetrics registers everything exported on /metrics. Anything that already keeps its own numbers, like
+// the database pool and the counts cache, is read when scraped rather than tracked twice.
+func (app *application) newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route and status.",
+		}, []string{"route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "How long HTTP requests take by route. Streams and WebSockets last as long as their connection.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route"}),
+		reactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reactions_total",
+			Help:      "Reactions accepted, and rejected by reason.",
+		}, []string{"result", "reason"}),
+	}
+
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Always 1, labelled with the version of the running server.",
+	}, []string{"version", "goversion"})
+	buildInfo.WithLabelValues(version.Get(), runtime.Version()).Set(1)
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.reactions,
+		buildInfo,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(app.db.DB.DB, "openheart"),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "background_tasks",
+			Help:      "Background tasks, workers and WebSocket connections the server waits for on shutdown.",
+		}, func() float64 { return float64(app.background.Load()) }),
+	)
+
+	if app.countsCache != nil {
+		stats := app.countsCache.Stats
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace, Name: "counts_cache_hits_total", Help: "Counts read from the cache.",
+			}, func() float64 { return float64(stats().Hits) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace, Name: "counts_cache_misses_total", Help: "Counts read from the database, as they weren't cached.",
+			}, func() float64 { return float64(stats().Misses) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace, Name: "counts_cache_evictions_total", Help: "Sites evicted from the full cache.",
+			}, func() float64 { return float64(stats().Evictions) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace, Name: "counts_cache_entries", Help: "Sites in the cache.",
+			}, func() float64 { return float64(stats().Entries) }),
+		)
+	}
+
+	for _, reason := range []string{errCodeBadRequest, errCodeInvalidUrl, errCodeInvalidEmoji, errCodeForbidden, errCodeRateLimited, errCodeServerError, errCodeServiceUnavailable} {
+		m.reactions.WithLabelValues(reactionRejected, reason)
+	}
+	m.reactions.WithLabelValues(reactionAccepted, "")
+
+	return m
+}
+
+func (app *application) metricsRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(app.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", app.healthz)
+	mux.HandleFunc("GET /readyz", app.readyzDetailed)
+	return mux
+}
+
+// rejectReaction counts a reaction that didn't make it, with one of the error codes as the reason
+func (app *application) rejectReaction(reason string) {
+	app.metrics.reactions.WithLabelValues(reactionRejected, reason).Inc()
+}
+
+// instrument records every request by the pattern of the route that served it, and names the request's span
+// after it. The mux sets the pattern on the request as it routes it, so it's only known once the handler
+// returns.
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+
+		defer func() {
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched"
+			} else {
+				_, path, _ := strings.Cut(route, " ")
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(route)
+				span.SetAttributes(semconv.HTTPRoute(path))
+			}
+			app.metrics.requests.WithLabelValues(route, strconv.Itoa(rec.statusCode())).Inc()
+			app.metrics.requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
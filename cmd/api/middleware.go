@@ -1,8 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	requestIdHeader    = "X-Request-ID"
+	maxRequestIdLength = 128
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -10,6 +24,10 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			err := recover()
 			if err != nil {
+				if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+					app.apiServerError(w, r, fmt.Errorf("%s", err))
+					return
+				}
 				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
@@ -17,3 +35,140 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requireAdmin only lets requests with the admin token through. Without a configured token, admin routes are disabled.
+func (app *application) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.config.adminToken == "" {
+			app.apiForbidden(w, r, "the admin API is disabled, as no admin token is configured")
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(app.config.adminToken)) != 1 {
+			app.apiUnauthorized(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// logRequests gives every request an id, taken from the X-Request-ID header when the client or a proxy sent
+// a sensible one, and a logger that labels everything with it. Once the request is done, it's logged.
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+
+		logger := app.logger.With("request_id", requestId)
+		r = contextSetRequestId(r, requestId)
+		r = contextSetLogger(r, logger)
+
+		rec := &responseRecorder{ResponseWriter: w}
+
+		defer func() {
+			// The query is left out, as is the client's address, which is only logged as the kind of network
+			// it's from
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("url", path.Clean("/"+r.URL.Path)),
+				slog.String("route", r.Pattern),
+				slog.Int("status", rec.statusCode()),
+				slog.Int64("bytes", rec.bytes),
+				slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("client", clientIPClass(r.RemoteAddr)),
+			)
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientIPClass describes where a client connected from without identifying it: loopback, private, public,
+// or unknown if the address can't be parsed
+func clientIPClass(remoteAddr string) string {
+	ip := net.ParseIP(clientHost(remoteAddr))
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return "private"
+	default:
+		return "public"
+	}
+}
+
+// clientHost strips the port from a client's address
+func clientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// responseRecorder keeps track of the status and size of a response, for logging and metrics
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, for flushing streams and clearing deadlines
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack is asserted on directly by the WebSocket library, rather than through http.ResponseController
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rec.ResponseWriter).Hijack()
+}
+
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"openheart.tylery.com/internal/version"
+)
+
+// OpenAPI has no notion of a wildcard that spans several segments, so {url...} is documented as {url}
+var rgxPathParam = regexp.MustCompile(`\{(\w+)(\.\.\.)?}`)
+
+func openAPIDocument(routes []route) map[string]any {
+	paths := map[string]map[string]any{}
+
+	for _, rt := range routes {
+		path := apiPrefix + rgxPathParam.ReplaceAllString(rt.path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(rt.method)] = openAPIOperation(rt)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "OpenHeart API",
+			"description": "A Go implementation of the Open Heart Protocol. Every response is wrapped in an envelope with either data or error set.",
+			"version":     version.Get(),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": openAPISchemas,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIOperation(rt route) map[string]any {
+	var parameters []map[string]any
+	for _, match := range rgxPathParam.FindAllStringSubmatch(rt.path, -1) {
+		description := ""
+		if match[2] != "" {
+			description = "May contain slashes, e.g. example.com/blog/post"
+		}
+		parameters = append(parameters, map[string]any{
+			"name":        match[1],
+			"in":          "path",
+			"required":    true,
+			"description": description,
+			"schema":      map[string]string{"type": "string"},
+		})
+	}
+	for _, param := range rt.query {
+		schema := map[string]any{"type": "string"}
+		if param.repeated {
+			schema = map[string]any{"type": "array", "items": schema}
+		}
+		parameters = append(parameters, map[string]any{
+			"name":        param.name,
+			"in":          "query",
+			"required":    param.required,
+			"description": param.description,
+			"schema":      schema,
+		})
+	}
+
+	status := rt.status
+	switch {
+	case rt.socket:
+		status = http.StatusSwitchingProtocols
+	case status == 0:
+		status = http.StatusOK
+	}
+
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case rt.stream:
+		success["content"] = map[string]any{
+			"text/event-stream": map[string]any{
+				"schema": map[string]string{
+					"type":        "string",
+					"description": "A \"counts\" event with a SiteCounts snapshot, then a \"reaction\" event with a Reaction for every reaction",
+				},
+			},
+		}
+	case rt.raw:
+		success["content"] = map[string]any{
+			"application/json": map[string]any{"schema": map[string]string{"type": "object"}},
+		}
+	case rt.response != "":
+		enveloped := map[string]any{
+			"schema": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"data": schemaRef(rt.response),
+				},
+			},
+		}
+		content := map[string]any{
+			"application/json":    enveloped,
+			"application/msgpack": enveloped,
+		}
+		// Counts can also be rendered as rows, one per emoji
+		if strings.HasPrefix(rt.response, "SiteCounts") {
+			for _, mediaType := range []string{"text/plain", "text/csv", "text/html"} {
+				content[mediaType] = map[string]any{"schema": map[string]string{"type": "string"}}
+			}
+		}
+		success["content"] = content
+	}
+
+	responses := map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": schemaRef("ErrorEnvelope")},
+			},
+		},
+	}
+	// A reaction to an emoji that already has a count answers 200, the first reaction 201
+	if rt.response == "Reaction" && status == http.StatusCreated {
+		responses[strconv.Itoa(http.StatusOK)] = success
+	}
+	// Counts carry an ETag and Last-Modified, for If-None-Match and If-Modified-Since
+	if strings.HasPrefix(rt.response, "SiteCounts") {
+		responses[strconv.Itoa(http.StatusNotModified)] = map[string]any{"description": "Not modified"}
+	}
+
+	operation := map[string]any{
+		"summary":     rt.summary,
+		"operationId": operationId(rt),
+		"responses":   responses,
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if rt.admin {
+		operation["security"] = []map[string][]string{{"adminToken": {}}}
+	}
+	if rt.request != "" {
+		content := map[string]any{
+			"application/json": map[string]any{"schema": schemaRef(rt.request)},
+		}
+		// Reactions are also accepted the way the root protocol routes take them
+		if rt.request == "ReactionRequest" {
+			content["text/plain"] = map[string]any{"schema": map[string]string{"type": "string"}}
+		}
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  content,
+		}
+	}
+
+	return operation
+}
+
+// operationId turns "GET /reactions/{url...}" into "getReactionsUrl"
+func operationId(rt route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.method))
+	for _, part := range strings.FieldsFunc(rgxPathParam.ReplaceAllString(rt.path, "$1"), func(r rune) bool {
+		return r == '/' || r == '.' || r == '_' || r == '-'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func schemaRef(name string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + name}
+}
+
+var openAPISchemas = map[string]any{
+	"Counts": map[string]any{
+		"type":                 "object",
+		"description":          "Reaction counts keyed by emoji",
+		"additionalProperties": map[string]string{"type": "integer"},
+		"example":              map[string]int{"💖": 5, "👍": 3},
+	},
+	"SiteCounts": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"url":    map[string]string{"type": "string"},
+			"counts": schemaRef("Counts"),
+		},
+	},
+	"SiteCountsList": map[string]any{
+		"type":  "array",
+		"items": schemaRef("SiteCounts"),
+	},
+	"ReactionRequest": map[string]any{
+		"type":     "object",
+		"required": []string{"emoji"},
+		"properties": map[string]any{
+			"emoji": map[string]string{"type": "string", "example": "💖"},
+		},
+	},
+	"Reaction": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"url":   map[string]string{"type": "string"},
+			"emoji": map[string]string{"type": "string"},
+			"count": map[string]string{"type": "integer"},
+		},
+	},
+	"WebhookRequest": map[string]any{
+		"type":     "object",
+		"required": []string{"url", "target"},
+		"properties": map[string]any{
+			"url":    map[string]string{"type": "string", "description": "The page URL to be notified about"},
+			"target": map[string]string{"type": "string", "description": "Where deliveries are POSTed"},
+			"secret": map[string]string{"type": "string", "description": "Signs deliveries, generated when omitted"},
+		},
+	},
+	"SiteRequest": map[string]any{
+		"type":     "object",
+		"required": []string{"origins"},
+		"properties": map[string]any{
+			"origins": map[string]any{
+				"type":        "array",
+				"items":       map[string]string{"type": "string"},
+				"description": "Origins such as https://example.com. Empty allows any origin.",
+			},
+		},
+	},
+	"Site": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"url":     map[string]string{"type": "string"},
+			"origins": map[string]any{"type": "array", "items": map[string]string{"type": "string"}},
+		},
+	},
+	"Webhook": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"id":     map[string]string{"type": "integer"},
+			"url":    map[string]string{"type": "string"},
+			"target": map[string]string{"type": "string"},
+			"secret": map[string]string{"type": "string"},
+		},
+	},
+	"WebhookList": map[string]any{
+		"type":  "array",
+		"items": schemaRef("Webhook"),
+	},
+	"Status": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"status":  map[string]string{"type": "string"},
+			"version": map[string]string{"type": "string"},
+			"cache": map[string]any{
+				"type":        "object",
+				"description": "Counts cache statistics, when the cache is enabled",
+				"properties": map[string]any{
+					"hits":      map[string]string{"type": "integer"},
+					"misses":    map[string]string{"type": "integer"},
+					"evictions": map[string]string{"type": "integer"},
+					"entries":   map[string]string{"type": "integer"},
+				},
+			},
+		},
+	},
+	"Error": map[string]any{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": map[string]any{
+			"code": map[string]any{
+				"type": "string",
+				"enum": []string{
+					errCodeBadRequest, errCodeInvalidUrl, errCodeInvalidEmoji, errCodeUnauthorized, errCodeForbidden,
+					errCodeNotFound, errCodeMethodNotAllowed, errCodeNotAcceptable, errCodeFailedValidation, errCodeServerError,
+					errCodeRateLimited, errCodeServiceUnavailable,
+				},
+			},
+			"message":    map[string]string{"type": "string"},
+			"details":    map[string]string{"type": "object"},
+			"request_id": map[string]string{"type": "string"},
+		},
+	},
+	"ErrorEnvelope": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error": schemaRef("Error"),
+		},
+	},
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+)
+
+// Serve prunes a while after starting rather than straight away, so a restart doesn't slow down on it
+const pruneStartDelay = time.Minute
+
+// prune is the prune command, which prunes once by the same settings serve does on prune-interval
+func (app *application) prune() error {
+	ctx := context.Background()
+	if len(app.config.args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", app.config.args)
+	}
+	if app.config.prune.idleDays == 0 && app.config.prune.compactDays == 0 {
+		return errors.New("nothing to prune, set prune-idle-days or prune-compact-days")
+	}
+
+	err := app.requireSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	report, err := app.db.Prune(ctx, app.prunePolicy(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return app.printPruneReport(os.Stdout, report)
+}
+
+// prunePolicy turns the prune settings into what's stale as of now. Prune takes the compaction cut-off back
+// to the start of its day in the database's time zone, so a day's rollup is made in one go.
+func (app *application) prunePolicy(now time.Time) database.PrunePolicy {
+	cfg := app.config.prune
+	policy := database.PrunePolicy{
+		MaxReactions: cfg.maxReactions,
+		Archive:      cfg.archive,
+		DryRun:       cfg.dryRun,
+	}
+	if cfg.idleDays > 0 {
+		policy.IdleSince = now.Add(-time.Duration(cfg.idleDays) * 24 * time.Hour)
+	}
+	if cfg.compactDays > 0 {
+		policy.CompactBefore = now.Add(-time.Duration(cfg.compactDays) * 24 * time.Hour)
+	}
+	return policy
+}
+
+func (app *application) printPruneReport(w io.Writer, report database.PruneReport) error {
+	sites := "Sites deleted"
+	switch {
+	case app.config.prune.dryRun:
+		fmt.Fprintf(w, "Dry run, nothing was changed.\n\n")
+		sites = "Sites to prune"
+	case app.config.prune.archive:
+		sites = "Sites archived"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if len(report.Sites) > 0 {
+		fmt.Fprintf(tw, "SITE\tREACTIONS\tLAST ACTIVE\n")
+		for _, site := range report.Sites {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", site.Url, site.Reactions, site.LastActive.Format(time.DateOnly))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprintf(tw, "%s:\t%d\n", sites, len(report.Sites))
+	fmt.Fprintf(tw, "Reactions compacted:\t%d\n", report.Reactions)
+	fmt.Fprintf(tw, "Daily rollups:\t%d\n", report.Rollups)
+	return tw.Flush()
+}
+
+// pruneOnSchedule prunes every prune-interval for as long as the server is up. Only one instance prunes a
+// database at a time, and the others skip their turn while it does.
+func (app *application) pruneOnSchedule(ctx context.Context) {
+	timer := time.NewTimer(pruneStartDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		started := time.Now()
+		report, err := app.db.Prune(ctx, app.prunePolicy(started))
+		switch {
+		case errors.Is(err, database.ErrPruneLocked):
+			app.logger.Info("skipping prune", "reason", err.Error())
+		case err != nil && !errors.Is(err, context.Canceled):
+			app.reportBackgroundError("pruner", err)
+		case err == nil:
+			app.logger.Info("pruned",
+				"dry_run", app.config.prune.dryRun,
+				"sites", len(report.Sites),
+				"reactions_compacted", report.Reactions,
+				"rollups", report.Rollups,
+				"duration", time.Since(started).String(),
+			)
+		}
+
+		timer.Reset(app.config.prune.interval)
+	}
+}
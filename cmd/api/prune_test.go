@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrunePolicy(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 30, 0, 0, time.UTC)
+
+	app := &application{}
+	app.config.prune.idleDays = 90
+	app.config.prune.maxReactions = 3
+	app.config.prune.archive = true
+	app.config.prune.compactDays = 365
+	app.config.prune.dryRun = true
+
+	policy := app.prunePolicy(now)
+	if want := time.Date(2024, 2, 10, 15, 30, 0, 0, time.UTC); !policy.IdleSince.Equal(want) {
+		t.Errorf("IdleSince = %s, want %s", policy.IdleSince, want)
+	}
+	// Left to Prune to take back to the start of the day, in the database's time zone rather than ours
+	if want := time.Date(2023, 5, 11, 15, 30, 0, 0, time.UTC); !policy.CompactBefore.Equal(want) {
+		t.Errorf("CompactBefore = %s, want %s", policy.CompactBefore, want)
+	}
+	if policy.MaxReactions != 3 || !policy.Archive || !policy.DryRun {
+		t.Errorf("policy = %+v, want the settings carried over", policy)
+	}
+
+	// Either half is off at zero days
+	app.config.prune.idleDays = 0
+	app.config.prune.compactDays = 0
+	policy = app.prunePolicy(now)
+	if !policy.IdleSince.IsZero() || !policy.CompactBefore.IsZero() {
+		t.Errorf("IdleSince = %s and CompactBefore = %s, want both zero", policy.IdleSince, policy.CompactBefore)
+	}
+}
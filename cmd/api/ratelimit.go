@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdleTime      = 3 * time.Minute
+)
+
+// rateLimiter limits how fast each client can react, with a token bucket per client address. A limit of 0
+// allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateLimitClient
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: map[string]*rateLimitClient{},
+	}
+}
+
+// set changes the limit, for the clients already seen too
+func (rl *rateLimiter) set(rps float64, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limit, rl.burst = rate.Limit(rps), burst
+	for _, client := range rl.clients {
+		client.limiter.SetLimit(rl.limit)
+		client.limiter.SetBurst(rl.burst)
+	}
+}
+
+func (rl *rateLimiter) allow(remoteAddr string) bool {
+	host := clientHost(remoteAddr)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.limit == 0 {
+		return true
+	}
+
+	client, exists := rl.clients[host]
+	if !exists {
+		client = &rateLimitClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[host] = client
+	}
+	client.lastSeen = time.Now()
+
+	return client.limiter.Allow()
+}
+
+// retryAfter is how long until a limited client has a reaction to spend again, in whole seconds
+func (rl *rateLimiter) retryAfter() string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return strconv.Itoa(int(math.Ceil(1 / float64(rl.limit))))
+}
+
+// sweep forgets clients that haven't reacted for a while. Their buckets have refilled by then, so it's as
+// if they were never seen.
+func (rl *rateLimiter) sweep() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for host, client := range rl.clients {
+		if time.Since(client.lastSeen) > rateLimitIdleTime {
+			delete(rl.clients, host)
+		}
+	}
+}
+
+func (app *application) sweepRateLimits(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.rateLimiter.sweep()
+		}
+	}
+}
+
+// rateLimit refuses reactions from clients that have used up their share
+func (app *application) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.rateLimiter.allow(r.RemoteAddr) {
+			app.rejectReaction(errCodeRateLimited)
+			w.Header().Set("Retry-After", app.rateLimiter.retryAfter())
+
+			if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+				app.apiRateLimited(w, r)
+				return
+			}
+			app.protocolError(w, r, http.StatusTooManyRequests, "TOO MANY REQUESTS")
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"openheart.tylery.com/internal/request"
+)
+
+// cachedCounts is what the counts cache holds for a site. The map is shared by every reader, so it's
+// replaced rather than changed.
+type cachedCounts struct {
+	counts   map[string]int
+	modified time.Time
+}
+
+// counts returns the counts for a site and when they last changed, from the cache when it's enabled. The
+// map is the caller's to change. Without the database, cached sites are still served, however long ago they
+// were cached.
+func (app *application) counts(ctx context.Context, site string) (map[string]int, time.Time, error) {
+	if app.countsCache == nil {
+		if !app.databaseReady() {
+			return nil, time.Time{}, errDatabaseUnavailable
+		}
+		return app.db.CountsModified(ctx, site)
+	}
+
+	if cached, ok := app.countsCache.Get(site); ok {
+		return maps.Clone(cached.counts), cached.modified, nil
+	}
+
+	var cached cachedCounts
+	err := errDatabaseUnavailable
+	if app.databaseReady() {
+		cached, err = app.countsCache.Load(site, func() (cachedCounts, error) {
+			counts, modified, err := app.db.CountsModified(ctx, site)
+			return cachedCounts{counts: counts, modified: modified}, err
+		})
+	}
+	if app.isUnavailable(err) {
+		if stale, ok := app.countsCache.GetStale(site); ok {
+			cached, err = stale, nil
+		}
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return maps.Clone(cached.counts), cached.modified, nil
+}
+
+// errBlocked refuses a reaction from a blocked client, or to a blocked site
+var errBlocked = errors.New("reaction blocked")
+
+// blocked checks a reaction against the configured blocklists
+func (app *application) blocked(r *http.Request, site string) bool {
+	current := app.currentSettings()
+
+	if slices.Contains(current.blockedSites, site) {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(clientHost(r.RemoteAddr))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range current.blockedClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addReaction records a single reaction for a site. Every route that accepts reactions goes through here,
+// so anything that needs to happen when a reaction lands belongs in this function.
+func (app *application) addReaction(r *http.Request, site string, emoji request.EmojiT) (int, bool, error) {
+	if app.blocked(r, site) {
+		app.rejectReaction(errCodeForbidden)
+		return 0, false, errBlocked
+	}
+
+	if !app.databaseReady() {
+		app.rejectReaction(errCodeServiceUnavailable)
+		return 0, false, errDatabaseUnavailable
+	}
+
+	count, created, err := app.db.AddReaction(r.Context(), site, emoji, app.config.recordReactions)
+	if err != nil {
+		app.rejectReaction(errCodeServerError)
+		return 0, false, err
+	}
+
+	app.requestLogger(r).InfoContext(r.Context(), "reaction", "url", site, "emoji", emoji.String(), "count", count)
+	app.metrics.reactions.WithLabelValues(reactionAccepted, "").Inc()
+
+	// The new count is known, so a cached site is updated rather than read again. Counts only go up, so a
+	// reaction that finished after this one can't be undone by this one updating the cache after it.
+	if app.countsCache != nil {
+		app.countsCache.Update(site, func(cached cachedCounts) cachedCounts {
+			counts := maps.Clone(cached.counts)
+			counts[emoji.String()] = max(counts[emoji.String()], count)
+			return cachedCounts{counts: counts, modified: time.Now()}
+		})
+	}
+
+	// Count is the new total rather than a delta, so a stream applying the same event twice, or on top
+	// of a snapshot that already includes it, is harmless
+	app.hub.Publish(site, reaction{Url: site, Emoji: emoji.String(), Count: count})
+	app.webhooks.add(site)
+
+	return count, created, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"openheart.tylery.com/internal/cache"
+)
+
+// An application without a database, as a server started degraded is before it comes up
+func newDegradedApp() *application {
+	return &application{
+		countsCache:  cache.New[cachedCounts](10, time.Millisecond),
+		originsCache: cache.New[[]string](10, time.Millisecond),
+	}
+}
+
+func TestCountsServedStaleWhileDegraded(t *testing.T) {
+	app := newDegradedApp()
+	app.countsCache.Load("example.com", func() (cachedCounts, error) {
+		return cachedCounts{counts: map[string]int{"💖": 3}}, nil
+	})
+	time.Sleep(2 * time.Millisecond)
+
+	counts, _, err := app.counts(context.Background(), "example.com")
+	if err != nil || counts["💖"] != 3 {
+		t.Errorf("counts = %v, %v, want the expired counts", counts, err)
+	}
+
+	_, _, err = app.counts(context.Background(), "uncached.com")
+	if !errors.Is(err, errDatabaseUnavailable) {
+		t.Errorf("counts = %v for a site that isn't cached, want errDatabaseUnavailable", err)
+	}
+}
+
+func TestAllowedOriginsWhileDegraded(t *testing.T) {
+	app := newDegradedApp()
+	app.originsCache.Load("example.com", func() ([]string, error) { return []string{"https://example.com"}, nil })
+	time.Sleep(2 * time.Millisecond)
+
+	origins, err := app.allowedOrigins(context.Background(), "example.com")
+	if err != nil || len(origins) != 1 {
+		t.Errorf("allowedOrigins = %v, %v, want the last known origins", origins, err)
+	}
+
+	origins, err = app.allowedOrigins(context.Background(), "uncached.com")
+	if err != nil || origins != nil {
+		t.Errorf("allowedOrigins = %v, %v for a site that isn't cached, want none, so cors-origins applies", origins, err)
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	app := newDegradedApp()
+
+	tests := map[error]bool{
+		errDatabaseUnavailable:                                          true,
+		fmt.Errorf("counts: %w", errDatabaseUnavailable):                true,
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")}: true,
+		errors.New("json: unsupported value"):                           false,
+	}
+	for err, want := range tests {
+		if got := app.isUnavailable(err); got != want {
+			t.Errorf("isUnavailable(%v) = %t while degraded, want %t", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+)
+
+// reloadable lists the settings a SIGHUP applies. The rest are only read on startup.
+var reloadable = []string{
+	"log-level", "rate-limit-rps", "rate-limit-burst", "blocked-clients", "blocked-sites", "cors-origins",
+	"cache-max-age", "counts-cache-ttl",
+}
+
+// settings are the reloadable parts of the config that requests read, swapped as a whole so a request never
+// sees half of a reload
+type settings struct {
+	cacheMaxAge    time.Duration
+	blockedClients []netip.Prefix
+	blockedSites   []string
+	corsOrigins    []string
+
+	values map[string]string // The config as applied, by flag name
+}
+
+func newSettings(cfg config) *settings {
+	return &settings{
+		cacheMaxAge:    cfg.cacheMaxAge,
+		blockedClients: cfg.blocked.clientPrefixes,
+		blockedSites:   cfg.blocked.siteUrls,
+		corsOrigins:    cfg.cors.originList,
+		values:         cfg.values,
+	}
+}
+
+func (app *application) currentSettings() *settings {
+	return app.settings.Load()
+}
+
+// reloadConfig reads the config again, the same way as on startup, and applies whatever changed that can be.
+// An invalid config is rejected as a whole, and the server carries on as it was.
+func (app *application) reloadConfig() {
+	cfg, err := loadConfig(os.Args)
+	if err != nil {
+		app.logger.Error("config reload rejected", "error", err.Error())
+		return
+	}
+
+	current := app.currentSettings()
+	values := maps.Clone(current.values)
+
+	var changes, needRestart []string
+	for _, name := range slices.Sorted(maps.Keys(cfg.values)) {
+		previous, value := current.values[name], cfg.values[name]
+		if previous == value {
+			continue
+		}
+		if slices.Contains(reloadable, name) {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, previous, value))
+			values[name] = value
+		} else {
+			needRestart = append(needRestart, name)
+		}
+	}
+
+	app.rateLimiter.set(cfg.rateLimit.rps, cfg.rateLimit.burst)
+	if app.countsCache != nil {
+		app.countsCache.SetTTL(cfg.countsCache.ttl)
+		app.originsCache.SetTTL(cfg.countsCache.ttl)
+	}
+
+	next := newSettings(cfg)
+	next.values = values
+	app.settings.Store(next)
+
+	// The reload is logged before a less verbose level hides it
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.logLevel))
+	app.logLevel.Set(min(app.logLevel.Level(), level))
+	defer app.logLevel.Set(level)
+
+	if len(changes) == 0 {
+		app.logger.Info("config reloaded, nothing changed")
+	} else {
+		app.logger.Info("config reloaded", "changes", changes)
+	}
+	// Secrets like the DSN may be among them, so only the names are logged
+	if len(needRestart) > 0 {
+		app.logger.Warn("config changes need a restart to apply", "settings", needRestart)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"openheart.tylery.com/internal/listen"
+)
+
+// restartOnSignal restarts the server on SIGUSR2, by starting a new copy of it on the same listeners. Once
+// it's ready, restarted is closed for this one to shut down. If it doesn't come up, this one carries on.
+func (app *application) restartOnSignal(ls listeners, restarted chan<- struct{}) (stop func()) {
+	restartChan := make(chan os.Signal, 1)
+	signal.Notify(restartChan, syscall.SIGUSR2)
+
+	go func() {
+		for range restartChan {
+			app.logger.Info("restarting", "timeout", app.config.restartTimeout.String())
+
+			process, err := listen.Restart(ls.inherited(), app.config.restartTimeout)
+			if err != nil {
+				app.logger.Error("restart failed", "error", err.Error())
+				continue
+			}
+
+			app.logger.Info("handed over to new process", "pid", process.Pid)
+			// Another SIGUSR2 would otherwise kill this one while it shuts down
+			signal.Ignore(syscall.SIGUSR2)
+			close(restarted)
+			return
+		}
+	}()
+
+	return func() { signal.Stop(restartChan) }
+}
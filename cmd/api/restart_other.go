@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// restartOnSignal does nothing without SIGUSR2, and restarted is never closed
+func (app *application) restartOnSignal(ls listeners, restarted chan<- struct{}) (stop func()) {
+	return func() {}
+}
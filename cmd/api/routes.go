@@ -2,16 +2,79 @@ package main
 
 import (
 	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// A route is a single versioned API endpoint. The same table registers the handlers and generates the
+// OpenAPI document, so the two can't drift apart.
+type route struct {
+	method   string
+	path     string
+	handler  http.HandlerFunc
+	summary  string
+	query    []routeParam
+	request  string // OpenAPI schema name of the request body, if any
+	response string // OpenAPI schema name of the envelope's data
+	status   int    // Success status, defaults to 200
+	raw      bool   // The response is not wrapped in an envelope
+	stream   bool   // The response is a text/event-stream
+	socket   bool   // The request is upgraded to a WebSocket
+	admin    bool   // The request needs the admin token
+	limited  bool   // The request is a reaction, and counts towards the client's rate limit
+}
+
+type routeParam struct {
+	name        string
+	description string
+	required    bool
+	repeated    bool
+}
+
+func (rt route) pattern() string {
+	return rt.method + " " + apiPrefix + rt.path
+}
+
 func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
 
 	//mux.HandleFunc("GET /", app.homePage)
 	mux.HandleFunc("GET /status", app.status)
+	mux.HandleFunc("GET /healthz", app.healthz)
+	mux.HandleFunc("GET /readyz", app.readyz)
+	mux.HandleFunc("GET /widget.js", app.widget)
+	mux.HandleFunc("GET /badge/{url...}", app.badge)
 	mux.HandleFunc("GET /{url...}", app.getAll)
 	//mux.HandleFunc("GET /{url}/{emoji}", app.getOne)
-	mux.HandleFunc("POST /{url...}", app.createOne)
+	mux.HandleFunc("POST /{url...}", app.rateLimit(app.createOne))
+
+	// The API gets its own mux. Its catch-all can't live next to the root wildcards, as
+	// "/api/v1/" and "GET /{url...}" overlap without either being more specific
+	apiRoutes := app.apiRoutes()
+	apiMux := http.NewServeMux()
+	for _, rt := range apiRoutes {
+		handler := rt.handler
+		if rt.admin {
+			handler = app.requireAdmin(handler)
+		}
+		if rt.limited {
+			handler = app.rateLimit(handler)
+		}
+		apiMux.HandleFunc(rt.pattern(), handler)
+	}
+	apiMux.HandleFunc(apiPrefix+"/", app.apiFallback(apiMux, apiRoutes))
+
+	root, api := app.cors(mux), app.cors(apiMux)
 
-	return app.recoverPanic(mux)
+	return proxiedClient(otelhttp.NewHandler(app.logRequests(app.instrument(app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			api.ServeHTTP(w, r)
+			return
+		}
+		root.ServeHTTP(w, r)
+	})))), "http.server", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		// Renamed to the route's pattern once the mux has picked one
+		return r.Method
+	})))
 }
@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"openheart.tylery.com/internal/certs"
+	"openheart.tylery.com/internal/listen"
 )
 
 const (
@@ -17,34 +21,199 @@ const (
 	defaultReadTimeout    = 5 * time.Second
 	defaultWriteTimeout   = 10 * time.Second
 	defaultShutdownPeriod = 30 * time.Second
+	defaultRestartTimeout = time.Minute
+	handoverGrace         = time.Second
 )
 
-func (app *application) serveHTTP() error {
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.httpPort),
-		Handler:      app.routes(),
+// Streaming routes outlive the server's read and write timeouts, so they clear the connection's deadlines
+// for themselves. Every other route keeps the server's.
+func clearDeadlines(w http.ResponseWriter) error {
+	rc := http.NewResponseController(w)
+
+	err := rc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	return rc.SetWriteDeadline(time.Time{})
+}
+
+func (app *application) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelWarn),
-		IdleTimeout:  defaultIdleTimeout,
-		ReadTimeout:  defaultReadTimeout,
-		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+	}
+}
+
+// startDatabaseWorkers starts the workers that need the database, once it's ready
+func (app *application) startDatabaseWorkers(ctx context.Context) {
+	app.backgroundWorker(ctx, "database monitor", app.monitorDatabase)
+	app.startWebhookWorkers(ctx)
+	if app.config.prune.interval > 0 {
+		app.backgroundWorker(ctx, "pruner", app.pruneOnSchedule)
+	}
+}
+
+// serveBackground runs one of the secondary servers, which log their failures rather than stopping the main one
+func (app *application) serveBackground(name string, srv *http.Server, listener net.Listener) {
+	go func() {
+		app.logger.Info("starting "+name, slog.Group("server", "addr", listener.Addr().String()))
+
+		err := srv.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.logger.Error(name+" failed", "error", err.Error())
+		}
+	}()
+}
+
+// serve is the serve command, and what the server does without one
+func (app *application) serve() error {
+	if len(app.config.args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", app.config.args)
+	}
+
+	// Degraded, the server comes up after a single attempt whatever happens, and serveHTTP carries on
+	// trying in the background
+	if app.config.db.startDegraded {
+		err := app.connectDatabase(context.Background(), 1)
+		if err != nil {
+			app.logger.Warn("starting degraded, without the database", "error", err.Error())
+		}
+	} else {
+		err := app.connectDatabase(context.Background(), app.config.db.connectAttempts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.serveHTTP()
+}
+
+func (app *application) serveHTTP() error {
+	srv := app.newServer(app.routes())
+
+	// With certificates the public port serves HTTPS. They're loaded up front, so a bad one stops startup
+	// rather than every handshake failing.
+	var certStore *certs.Store
+	var err error
+	if len(app.config.tls.pairs) > 0 {
+		certStore, err = certs.Load(app.config.tls.pairs)
+		if err != nil {
+			return err
+		}
+		app.tlsConfig(srv, certStore)
+	}
+
+	ls, err := app.openListeners(certStore != nil)
+	if err != nil {
+		return err
 	}
 
+	// Shutdown waits for active requests, which would include every open event stream, and doesn't know
+	// about hijacked WebSocket connections at all. Closing the hub ends both as soon as shutdown starts,
+	// and clients reconnect to another instance.
+	srv.RegisterOnShutdown(app.hub.Close)
+
+	// Workers keep going until every request has finished, as requests can still hand them work
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	app.backgroundWorker(workerCtx, "rate limit sweeper", app.sweepRateLimits)
+	if certStore != nil {
+		app.backgroundWorker(workerCtx, "certificate watcher", func(ctx context.Context) {
+			app.watchCertificates(ctx, certStore)
+		})
+	}
+
+	if app.databaseReady() {
+		app.startDatabaseWorkers(workerCtx)
+	} else {
+		app.backgroundWorker(workerCtx, "database connector", app.connectInBackground)
+	}
+
+	// The admin port serves /metrics, away from the public port
+	var adminSrv *http.Server
+	if ls.admin != nil {
+		adminSrv = app.newServer(app.metricsRoutes())
+		app.serveBackground("admin server", adminSrv, ls.admin)
+	}
+
+	var redirectSrv *http.Server
+	if ls.redirect != nil {
+		redirectSrv = app.newServer(app.redirectToHTTPS(app.httpsPort(ls.public)))
+		app.serveBackground("redirect server", redirectSrv, ls.redirect)
+	}
+
+	// SIGHUP reloads the config, for as long as the server is up
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+	go func() {
+		for range reloadChan {
+			app.reloadConfig()
+		}
+	}()
+
+	// SIGUSR2 hands the listeners to a new process, and shuts this one down once it has taken over
+	restartedChan := make(chan struct{})
+	stopRestarts := app.restartOnSignal(ls, restartedChan)
+	defer stopRestarts()
+
 	shutdownErrorChan := make(chan error)
 
 	go func() {
 		quitChan := make(chan os.Signal, 1)
 		signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
-		<-quitChan
 
-		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
+		select {
+		case <-quitChan:
+			// Readiness fails from here on. Load balancers take a few probes to notice, so we keep serving
+			// for a while before refusing connections.
+			app.shuttingDown.Store(true)
+			if app.config.drainDelay > 0 {
+				app.logger.Info("draining", "delay", app.config.drainDelay.String())
+				time.Sleep(app.config.drainDelay)
+			}
+		case <-restartedChan:
+			// The new process accepts connections on the same listeners, so there's nothing to drain. Shutdown
+			// drops connections it hasn't read a request from yet though, so this one stops accepting them
+			// first, and gives those it has a moment to send theirs.
+			app.shuttingDown.Store(true)
+			ls.stop()
+			time.Sleep(handoverGrace)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 
-		shutdownErrorChan <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		if redirectSrv != nil {
+			err = errors.Join(err, redirectSrv.Shutdown(ctx))
+		}
+		// Metrics keep being served until the public server has drained
+		if adminSrv != nil {
+			err = errors.Join(err, adminSrv.Shutdown(ctx))
+		}
+		shutdownErrorChan <- err
 	}()
 
-	app.logger.Info("starting server", slog.Group("server", "addr", srv.Addr))
+	addr := ls.public.Addr().String()
+	app.logger.Info("starting server", slog.Group("server", "addr", addr, "tls", certStore != nil))
+
+	// Connections queue up on the listeners until they're served, so a process restarting this one can
+	// leave them to us already
+	err = listen.Ready()
+	if err != nil {
+		app.logger.Warn("unable to report ready to the previous process", "error", err.Error())
+	}
 
-	err := srv.ListenAndServe()
+	if certStore != nil {
+		err = srv.ServeTLS(ls.public, "", "")
+	} else {
+		err = srv.Serve(ls.public)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -54,8 +223,9 @@ func (app *application) serveHTTP() error {
 		return err
 	}
 
-	app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
+	app.logger.Info("stopped server", slog.Group("server", "addr", addr))
 
+	stopWorkers()
 	app.wg.Wait()
 	return nil
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/pubsub"
+	"openheart.tylery.com/internal/request"
+)
+
+const (
+	maxSocketMessageSize   = 4096
+	maxSocketSubscriptions = 100
+	socketPingInterval     = 30 * time.Second
+	socketWriteTimeout     = 10 * time.Second
+)
+
+// Messages sent by the client. Id is optional, and is echoed back on the reply so the client can match them up.
+//
+//	{"type": "subscribe", "url": "example.com"}
+//	{"type": "unsubscribe", "url": "example.com"}
+//	{"type": "react", "url": "example.com", "emoji": "💖", "id": "1"}
+type socketRequest struct {
+	Type  string `json:"type"`
+	Id    string `json:"id,omitempty"`
+	Url   string `json:"url"`
+	Emoji string `json:"emoji,omitempty"`
+}
+
+// Messages sent by the server. A subscribe is answered with "counts", after which every reaction to the
+// url arrives as a "reaction". A react is answered with "reaction" too, carrying the id of the request.
+// "unsubscribed" means the server dropped a subscription because the client fell behind, and "error"
+// carries the same codes as the API's error envelope.
+type socketResponse struct {
+	Type   string    `json:"type"`
+	Id     string    `json:"id,omitempty"`
+	Url    string    `json:"url,omitempty"`
+	Emoji  string    `json:"emoji,omitempty"`
+	Count  int       `json:"count,omitempty"`
+	Counts any       `json:"counts,omitempty"` // An empty map is still sent, only a nil one is omitted
+	Error  *apiError `json:"error,omitempty"`
+}
+
+type socket struct {
+	app  *application
+	conn *websocket.Conn
+	r    *http.Request
+
+	mu            sync.Mutex
+	subscriptions map[string]*pubsub.Subscription
+}
+
+// websocket lets a single connection send reactions, and receive live counts for many urls
+func (app *application) websocket(w http.ResponseWriter, r *http.Request) {
+	err := clearDeadlines(w)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	// The protocol is meant to be called from any site, so any origin may connect
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		// Accept has already written the response
+		return
+	}
+	conn.SetReadLimit(maxSocketMessageSize)
+
+	// Hijacked connections aren't waited on by srv.Shutdown, so we track them ourselves
+	app.wg.Add(1)
+	app.background.Add(1)
+	defer app.wg.Done()
+	defer app.background.Add(-1)
+
+	s := &socket{
+		app:           app,
+		conn:          conn,
+		r:             r,
+		subscriptions: map[string]*pubsub.Subscription{},
+	}
+	defer s.unsubscribeAll()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go s.keepAlive(ctx)
+
+	for {
+		msgType, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+
+		var msg socketRequest
+		if msgType != websocket.MessageText || json.Unmarshal(data, &msg) != nil {
+			s.error(ctx, msg, errCodeBadRequest, "messages must be JSON text")
+			continue
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			s.subscribe(ctx, msg)
+		case "unsubscribe":
+			s.unsubscribe(msg)
+		case "react":
+			s.react(ctx, msg)
+		default:
+			s.error(ctx, msg, errCodeBadRequest, "unknown message type")
+		}
+	}
+}
+
+// keepAlive pings the client, and closes the connection when the server shuts down
+func (s *socket) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(socketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.app.hub.Done():
+			s.conn.Close(websocket.StatusGoingAway, "server shutting down")
+			return
+
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, socketWriteTimeout)
+			err := s.conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				s.conn.Close(websocket.StatusGoingAway, "ping timeout")
+				return
+			}
+		}
+	}
+}
+
+func (s *socket) subscribe(ctx context.Context, msg socketRequest) {
+	parsedUrl, err := request.InputUrl(msg.Url).Parse()
+	if err != nil {
+		s.error(ctx, msg, errCodeInvalidUrl, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.subscriptions[parsedUrl]
+	full := len(s.subscriptions) >= maxSocketSubscriptions
+	s.mu.Unlock()
+	if !exists && full {
+		s.error(ctx, msg, errCodeBadRequest, "too many subscriptions")
+		return
+	}
+
+	// Subscribe before reading the counts, so no reaction falls in between. Reactions carry the new total,
+	// so one that is also in the snapshot is harmless.
+	var sub *pubsub.Subscription
+	if !exists {
+		sub, _, _ = s.app.hub.Subscribe(parsedUrl, 0)
+	}
+
+	counts, _, err := s.app.counts(ctx, parsedUrl)
+	if errors.Is(err, database.ErrNotFound) {
+		counts = map[string]int{}
+	} else if err != nil {
+		if sub != nil {
+			sub.Close()
+		}
+		s.serverError(ctx, msg, err)
+		return
+	}
+
+	// Subscribing again to the same url only repeats the snapshot
+	s.write(ctx, socketResponse{Type: "counts", Id: msg.Id, Url: parsedUrl, Counts: counts})
+	if sub == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.subscriptions[parsedUrl] = sub
+	s.mu.Unlock()
+
+	go func() {
+		for event := range sub.C {
+			data, ok := event.Data.(reaction)
+			if ok {
+				s.write(ctx, socketResponse{Type: "reaction", Url: data.Url, Emoji: data.Emoji, Count: data.Count})
+			}
+		}
+
+		// The hub drops subscribers that fall behind. Let the client know, so it can subscribe again.
+		s.mu.Lock()
+		current := s.subscriptions[parsedUrl] == sub
+		if current {
+			delete(s.subscriptions, parsedUrl)
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.app.hub.Done():
+			// The connection is about to be closed anyway
+		default:
+			if current && ctx.Err() == nil {
+				s.write(ctx, socketResponse{Type: "unsubscribed", Url: parsedUrl})
+			}
+		}
+	}()
+}
+
+func (s *socket) unsubscribe(msg socketRequest) {
+	parsedUrl, err := request.InputUrl(msg.Url).Parse()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	sub, exists := s.subscriptions[parsedUrl]
+	delete(s.subscriptions, parsedUrl)
+	s.mu.Unlock()
+
+	if exists {
+		sub.Close()
+	}
+}
+
+func (s *socket) unsubscribeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for parsedUrl, sub := range s.subscriptions {
+		sub.Close()
+		delete(s.subscriptions, parsedUrl)
+	}
+}
+
+// react is the socket's equivalent of createOne, and validates the same way
+func (s *socket) react(ctx context.Context, msg socketRequest) {
+	if !s.app.rateLimiter.allow(s.r.RemoteAddr) {
+		s.app.rejectReaction(errCodeRateLimited)
+		s.error(ctx, msg, errCodeRateLimited, "too many reactions, slow down")
+		return
+	}
+
+	parsedUrl, err := request.InputUrl(msg.Url).Parse()
+	if err != nil {
+		s.app.rejectReaction(errCodeInvalidUrl)
+		s.error(ctx, msg, errCodeInvalidUrl, err.Error())
+		return
+	}
+
+	if len(msg.Emoji) > maxPayloadByteSize {
+		s.app.rejectReaction(errCodeInvalidEmoji)
+		s.error(ctx, msg, errCodeInvalidEmoji, "emoji is too long")
+		return
+	}
+	emoji, err := request.ParseEmoji("text/plain", []byte(msg.Emoji))
+	if err != nil {
+		s.app.rejectReaction(errCodeInvalidEmoji)
+		s.error(ctx, msg, errCodeInvalidEmoji, err.Error())
+		return
+	}
+
+	// Browsers always send the origin of the page that opened the socket, which the site may not allow
+	if origin := s.r.Header.Get("Origin"); origin != "" {
+		_, allowed, err := s.app.originAllowed(ctx, origin, []string{parsedUrl})
+		if err != nil {
+			s.serverError(ctx, msg, err)
+			return
+		}
+		if !allowed {
+			s.app.rejectReaction(errCodeForbidden)
+			s.error(ctx, msg, errCodeForbidden, "this site doesn't accept reactions from your origin")
+			return
+		}
+	}
+
+	count, _, err := s.app.addReaction(s.r, parsedUrl, emoji)
+	if errors.Is(err, errBlocked) {
+		s.error(ctx, msg, errCodeForbidden, "reactions to this site aren't accepted from you")
+		return
+	}
+	if err != nil {
+		s.serverError(ctx, msg, err)
+		return
+	}
+
+	s.write(ctx, socketResponse{Type: "reaction", Id: msg.Id, Url: parsedUrl, Emoji: emoji.String(), Count: count})
+}
+
+func (s *socket) error(ctx context.Context, msg socketRequest, code string, message string) {
+	message = capitalize(message)
+	s.write(ctx, socketResponse{Type: "error", Id: msg.Id, Url: msg.Url, Error: &apiError{Code: code, Message: message}})
+}
+
+func (s *socket) serverError(ctx context.Context, msg socketRequest, err error) {
+	if s.app.isUnavailable(err) {
+		s.error(ctx, msg, errCodeServiceUnavailable, "the database is unavailable, try again shortly")
+		return
+	}
+
+	s.app.reportServerError(s.r, err)
+
+	message := "The server encountered a problem and could not process your request"
+	s.error(ctx, msg, errCodeServerError, message)
+}
+
+// write is safe to call from several goroutines, the connection serializes writes
+func (s *socket) write(ctx context.Context, msg socketResponse) {
+	ctx, cancel := context.WithTimeout(ctx, socketWriteTimeout)
+	defer cancel()
+
+	js, err := json.Marshal(msg)
+	if err != nil {
+		s.app.reportServerError(s.r, err)
+		return
+	}
+
+	err = s.conn.Write(ctx, websocket.MessageText, js)
+	if err != nil {
+		s.conn.Close(websocket.StatusGoingAway, "write failed")
+	}
+}
@@ -0,0 +1,184 @@
+// OpenHeart widget. Renders an emoji palette with live counts for the current page.
+//
+//   <script src="https://openheart.tylery.com/widget.js" defer></script>
+//   <open-heart data-emoji="💖,👍,🎉"></open-heart>
+//
+// Attributes, all optional:
+//   data-url     The page to react to, defaults to the current page without its protocol, query or hash
+//   data-emoji   Comma separated palette, defaults to ❤️,👍,🌟,🎉
+//   data-server  The OpenHeart server, defaults to wherever this script was loaded from
+//   data-live    "false" to fetch counts once instead of keeping them live
+//   data-theme   "light", "dark" or "auto" (default)
+(() => {
+    'use strict';
+
+    if (customElements.get('open-heart')) return;
+
+    const script = document.currentScript;
+    const defaultServer = script ? new URL(script.src).origin : location.origin;
+    const defaultEmoji = ['❤️', '👍', '🌟', '🎉'];
+
+    const style = `
+        :host { display: inline-block; font-family: system-ui, -apple-system, sans-serif; }
+        :host([hidden]) { display: none; }
+        .palette { display: inline-flex; flex-wrap: wrap; gap: 0.4rem; }
+        button {
+            font: inherit; font-size: 1.1rem; line-height: 1; cursor: pointer;
+            display: inline-flex; align-items: center; gap: 0.35rem;
+            padding: 0.35rem 0.6rem; border-radius: 999px;
+            border: 1px solid var(--open-heart-border, #ddd);
+            background: var(--open-heart-background, #fff);
+            color: var(--open-heart-color, #444);
+            transition: transform 0.1s ease, background 0.2s ease;
+        }
+        button:hover { background: var(--open-heart-hover, #f4f4f4); }
+        button:active { transform: scale(0.95); }
+        button[aria-pressed="true"] { border-color: var(--open-heart-accent, #e94e77); cursor: default; }
+        .count { font-size: 0.85rem; font-variant-numeric: tabular-nums; }
+        :host([data-theme="dark"]) button {
+            --open-heart-border: #444; --open-heart-background: #222; --open-heart-color: #eee; --open-heart-hover: #333;
+        }
+        @media (prefers-color-scheme: dark) {
+            :host(:not([data-theme="light"])) button {
+                --open-heart-border: #444; --open-heart-background: #222; --open-heart-color: #eee; --open-heart-hover: #333;
+            }
+        }
+    `;
+
+    class OpenHeart extends HTMLElement {
+        constructor() {
+            super();
+            this.attachShadow({ mode: 'open' });
+            this.stream = null;
+        }
+
+        get server() {
+            return (this.dataset.server || defaultServer).replace(/\/+$/, '');
+        }
+
+        get url() {
+            return this.dataset.url || (location.host + location.pathname).replace(/\/+$/, '');
+        }
+
+        get palette() {
+            const emoji = (this.dataset.emoji || '').split(',').map(e => e.trim()).filter(Boolean);
+            return emoji.length ? emoji : defaultEmoji;
+        }
+
+        get endpoint() {
+            return this.server + '/' + this.url;
+        }
+
+        connectedCallback() {
+            this.render();
+            if (this.dataset.live === 'false' || !window.EventSource) {
+                this.fetchCounts();
+            } else {
+                this.watchCounts();
+            }
+        }
+
+        disconnectedCallback() {
+            if (this.stream) this.stream.close();
+            this.stream = null;
+        }
+
+        render() {
+            const palette = document.createElement('div');
+            palette.className = 'palette';
+            palette.setAttribute('role', 'group');
+            palette.setAttribute('aria-label', 'Reactions');
+
+            for (const emoji of this.palette) {
+                const button = document.createElement('button');
+                button.type = 'button';
+                button.dataset.emoji = emoji;
+                button.setAttribute('aria-pressed', String(this.hasReacted(emoji)));
+                button.innerHTML = '<span class="emoji"></span><span class="count">0</span>';
+                button.querySelector('.emoji').textContent = emoji;
+                button.addEventListener('click', () => this.react(emoji));
+                palette.appendChild(button);
+            }
+
+            const styleElement = document.createElement('style');
+            styleElement.textContent = style;
+            this.shadowRoot.replaceChildren(styleElement, palette);
+        }
+
+        setCount(emoji, count) {
+            for (const button of this.shadowRoot.querySelectorAll('button')) {
+                if (button.dataset.emoji === emoji) {
+                    button.querySelector('.count').textContent = count;
+                    button.setAttribute('aria-label', `${emoji} ${count}`);
+                }
+            }
+        }
+
+        setCounts(counts) {
+            for (const emoji of this.palette) {
+                this.setCount(emoji, counts[emoji] || 0);
+            }
+        }
+
+        async fetchCounts() {
+            try {
+                const response = await fetch(this.endpoint);
+                // A page nobody reacted to yet is a 404
+                this.setCounts(response.ok ? await response.json() : {});
+            } catch (error) {
+                console.error('open-heart: error fetching counts', error);
+            }
+        }
+
+        watchCounts() {
+            this.stream = new EventSource(this.server + '/api/v1/stream/' + this.url);
+            this.stream.addEventListener('counts', event => this.setCounts(JSON.parse(event.data).counts));
+            this.stream.addEventListener('reaction', event => {
+                const data = JSON.parse(event.data);
+                this.setCount(data.emoji, data.count);
+            });
+        }
+
+        storageKey(emoji) {
+            return `open-heart:${this.url}:${emoji}`;
+        }
+
+        hasReacted(emoji) {
+            try {
+                return localStorage.getItem(this.storageKey(emoji)) !== null;
+            } catch (error) {
+                return false;
+            }
+        }
+
+        async react(emoji) {
+            if (this.hasReacted(emoji)) return;
+
+            try {
+                // A text/plain body keeps this a simple request, without a CORS preflight
+                const response = await fetch(this.endpoint, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'text/plain', 'Accept': 'application/json' },
+                    body: emoji,
+                });
+                if (!response.ok) return;
+
+                const data = await response.json();
+                this.setCount(emoji, data[emoji] || 0);
+                try {
+                    localStorage.setItem(this.storageKey(emoji), String(Date.now()));
+                } catch (error) {
+                    // Private browsing, the reaction still counts
+                }
+                const button = this.shadowRoot.querySelector(`button[data-emoji="${CSS.escape(emoji)}"]`);
+                if (button) button.setAttribute('aria-pressed', 'true');
+
+                this.dispatchEvent(new CustomEvent('open-heart', { detail: { emoji, count: data[emoji] }, bubbles: true }));
+            } catch (error) {
+                console.error('open-heart: error sending reaction', error);
+            }
+        }
+    }
+
+    customElements.define('open-heart', OpenHeart);
+})();
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/pubsub"
+	"openheart.tylery.com/internal/request"
+)
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultStreamHistory     = 64
+	streamRetry              = 3 * time.Second
+)
+
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// stream pushes count updates for a single site as Server-Sent Events. The stream opens with a "counts"
+// snapshot, unless the client resumes with a Last-Event-ID we still have the history for, followed by a
+// "reaction" event for every reaction that lands.
+func (app *application) stream(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.PathValue("url")).Parse()
+	if err != nil {
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	err = clearDeadlines(w)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+	rc := http.NewResponseController(w)
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	lastId, _ := strconv.ParseUint(lastEventId, 10, 64)
+
+	sub, backlog, complete := app.hub.Subscribe(parsedUrl, lastId)
+	defer sub.Close()
+
+	var snapshotId uint64
+	var counts map[string]int
+	if !complete {
+		snapshotId = app.hub.LastId()
+		counts, _, err = app.counts(r.Context(), parsedUrl)
+		if errors.Is(err, database.ErrNotFound) {
+			counts = map[string]int{}
+		} else if err != nil {
+			app.apiServerError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	if err != nil {
+		return
+	}
+
+	if !complete {
+		err = writeEvent(w, pubsub.Event{Id: snapshotId, Data: siteCounts{Url: parsedUrl, Counts: counts}}, "counts")
+		if err != nil {
+			return
+		}
+	}
+	for _, event := range backlog {
+		if !complete && event.Id <= snapshotId {
+			continue
+		}
+		err = writeEvent(w, event, "reaction")
+		if err != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(defaultHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.C:
+			// The hub closed the subscription, either we're shutting down or the client fell behind.
+			// Either way the client reconnects and resumes from its last event id.
+			if !ok {
+				return
+			}
+			err = writeEvent(w, event, "reaction")
+
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			return
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event pubsub.Event, name string) error {
+	js, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, name, js)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"openheart.tylery.com/internal/certs"
+)
+
+// How often certificate files are checked for changes, so renewed certificates are picked up without a restart
+const certReloadInterval = 30 * time.Second
+
+// tlsConfig serves the configured certificates by SNI. HTTP/2 is offered unless it's turned off, in which case
+// the server has to be stopped from setting it up itself.
+func (app *application) tlsConfig(srv *http.Server, store *certs.Store) {
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.GetCertificate,
+	}
+
+	if !app.config.server.http2 {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
+
+func (app *application) watchCertificates(ctx context.Context, store *certs.Store) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := store.Reload()
+			if err != nil {
+				app.reportBackgroundError("certificate watcher", err)
+				continue
+			}
+			if reloaded {
+				app.logger.Info("certificates reloaded")
+			}
+		}
+	}
+}
+
+// httpsPort is the port clients reach HTTPS on: https-public-port when it's set, as with a NAT or load
+// balancer in front, and otherwise the one the public listener is actually on, which can be an inherited
+// socket's rather than http-port. A Unix socket has no port of its own, so HTTPS is taken to be on 443.
+func (app *application) httpsPort(public net.Listener) int {
+	if app.config.tls.publicPort != 0 {
+		return app.config.tls.publicPort
+	}
+	if addr, ok := public.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 443
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS on port. 308 keeps the method and body,
+// so reactions sent over HTTP are made again rather than turned into GETs.
+func (app *application) redirectToHTTPS(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if host == "" {
+			app.protocolError(w, r, http.StatusBadRequest, "BAD REQUEST")
+			return
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	tests := []struct {
+		name   string
+		port   int
+		method string
+		target string
+		host   string
+		want   string
+	}{
+		{"default port", 443, http.MethodGet, "/example.com/post?a=1", "example.com", "https://example.com/example.com/post?a=1"},
+		{"port on the host is replaced", 443, http.MethodGet, "/", "example.com:8080", "https://example.com/"},
+		{"another port", 8443, http.MethodPost, "/example.com", "example.com", "https://example.com:8443/example.com"},
+		{"ipv6", 8443, http.MethodGet, "/", "[::1]:80", "https://[::1]:8443/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			app.redirectToHTTPS(tt.port)(w, r)
+
+			if w.Code != http.StatusPermanentRedirect {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusPermanentRedirect)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no host", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = ""
+		w := httptest.NewRecorder()
+		app.redirectToHTTPS(443)(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestHTTPSPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	app := &application{}
+	app.config.httpPort = 443
+	if got := app.httpsPort(l); got != port {
+		t.Errorf("httpsPort = %d, want the listener's %d", got, port)
+	}
+
+	app.config.tls.publicPort = 8443
+	if got := app.httpsPort(l); got != 8443 {
+		t.Errorf("httpsPort = %d, want https-public-port's 8443", got)
+	}
+}
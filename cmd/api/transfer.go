@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/validator"
+)
+
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+
+	// Long enough for a site with thousands of emoji on one line
+	maxImportLine = 1 << 20
+
+	importProgressInterval = 5 * time.Second
+)
+
+// Every CSV export starts with this header. A row is either the count of an emoji on a site, a single
+// reaction, which leaves count empty and has a time instead, or a rollup, which has both, with a date as time.
+var csvHeader = []string{"record", "url", "emoji", "count", "time"}
+
+// importRecord is a line of an import, which is either a site's counts, a rollup or a reaction
+type importRecord struct {
+	site     *database.SiteCounts
+	rollup   *database.Rollup
+	reaction *database.Reaction
+}
+
+// exportWriter writes each kind of record in an export's format
+type exportWriter struct {
+	site     func(database.SiteCounts) error
+	rollup   func(database.Rollup) error
+	reaction func(database.Reaction) error
+	flush    func() error
+}
+
+// export is the export command. In JSON Lines, every line is a site, or with -reactions, a day of reactions
+// that's been compacted, or a single reaction:
+//
+//	{"url":"example.com","counts":{"❤️":3,"👍":1}}
+//	{"url":"example.com","emoji":"❤️","day":"2023-05-01","count":2}
+//	{"url":"example.com","emoji":"❤️","time":"2024-05-01T12:00:00Z"}
+func (app *application) export() (err error) {
+	ctx := context.Background()
+	if len(app.config.args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", app.config.args)
+	}
+	format := app.config.export.format
+	if validator.NotIn(format, formatJSONL, formatCSV) {
+		return fmt.Errorf("format must be %s or %s", formatJSONL, formatCSV)
+	}
+
+	err = app.requireSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if app.config.export.output != "-" {
+		out, err = os.Create(app.config.export.output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, out.Close())
+		}()
+	}
+
+	w := bufio.NewWriter(out)
+	ew := jsonlWriter(w)
+	if format == formatCSV {
+		ew = csvWriter(w)
+	}
+
+	var sites, rollups, reactions int
+	err = app.db.ExportCounts(ctx, func(site database.SiteCounts) error {
+		sites++
+		return ew.site(site)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Compacted reactions are history all the same, and come first as they're the oldest
+	if app.config.export.reactions {
+		err = app.db.ExportRollups(ctx, func(rollup database.Rollup) error {
+			rollups++
+			return ew.rollup(rollup)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = app.db.ExportReactions(ctx, func(reaction database.Reaction) error {
+			reactions++
+			return ew.reaction(reaction)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ew.flush()
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("exported", "sites", sites, "rollups", rollups, "reactions", reactions, "format", format)
+	return nil
+}
+
+func jsonlWriter(w *bufio.Writer) exportWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	return exportWriter{
+		site:     func(site database.SiteCounts) error { return encoder.Encode(site) },
+		rollup:   func(rollup database.Rollup) error { return encoder.Encode(rollup) },
+		reaction: func(reaction database.Reaction) error { return encoder.Encode(reaction) },
+		flush:    w.Flush,
+	}
+}
+
+func csvWriter(w *bufio.Writer) exportWriter {
+	cw := csv.NewWriter(w)
+	header := false
+
+	writeHeader := func() error {
+		if header {
+			return nil
+		}
+		header = true
+		return cw.Write(csvHeader)
+	}
+
+	writeSite := func(site database.SiteCounts) error {
+		err := writeHeader()
+		if err != nil {
+			return err
+		}
+		for _, emoji := range slices.Sorted(maps.Keys(site.Counts)) {
+			err = cw.Write([]string{"count", site.Url, emoji, strconv.Itoa(site.Counts[emoji]), ""})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writeRollup := func(rollup database.Rollup) error {
+		err := writeHeader()
+		if err != nil {
+			return err
+		}
+		return cw.Write([]string{"rollup", rollup.Url, rollup.Emoji, strconv.Itoa(rollup.Count), rollup.Day})
+	}
+	writeReaction := func(reaction database.Reaction) error {
+		err := writeHeader()
+		if err != nil {
+			return err
+		}
+		return cw.Write([]string{"reaction", reaction.Url, reaction.Emoji, "", reaction.Time.Format(time.RFC3339)})
+	}
+	flush := func() error {
+		err := writeHeader()
+		if err != nil {
+			return err
+		}
+		cw.Flush()
+		if cw.Error() != nil {
+			return cw.Error()
+		}
+		return w.Flush()
+	}
+	return exportWriter{site: writeSite, rollup: writeRollup, reaction: writeReaction, flush: flush}
+}
+
+// importData is the import command, which reads what export writes. The whole import is checked before any
+// of it is written, then it's written in batches, see importer.
+func (app *application) importData() (err error) {
+	ctx := context.Background()
+	if len(app.config.args) > 1 {
+		return fmt.Errorf("unexpected arguments %q", app.config.args[1:])
+	}
+	merge, err := app.importMerge()
+	if err != nil {
+		return err
+	}
+
+	path := "-"
+	if len(app.config.args) == 1 {
+		path = app.config.args[0]
+	}
+	format := app.config.importing.format
+	if format == "" {
+		format = formatJSONL
+		if filepath.Ext(path) == ".csv" {
+			format = formatCSV
+		}
+	}
+	if validator.NotIn(format, formatJSONL, formatCSV) {
+		return fmt.Errorf("format must be %s or %s", formatJSONL, formatCSV)
+	}
+
+	in, err := openImport(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// The first pass checks every record, and identifies the import by its contents
+	hash := sha256.New()
+	var total int
+	err = readRecords(io.TeeReader(in, hash), format, func(record importRecord) error {
+		total += record.size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = app.requireSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	im := app.newImporter(ctx, hex.EncodeToString(hash.Sum(nil)), merge, total)
+	err = readRecords(in, format, im.add)
+	if err != nil {
+		return err
+	}
+	return im.finish()
+}
+
+// importMerge returns the merge mode imports were given, after checking the settings they share
+func (app *application) importMerge() (database.MergeMode, error) {
+	merge := database.MergeMode(app.config.importing.merge)
+	if validator.NotIn(merge, database.MergeSum, database.MergeReplace, database.MergeMax) {
+		return "", fmt.Errorf("merge must be %s, %s or %s", database.MergeSum, database.MergeReplace, database.MergeMax)
+	}
+	if app.config.importing.batchSize < 1 {
+		return "", errors.New("batch-size must be more than 0")
+	}
+	return merge, nil
+}
+
+// importer writes records in batches of their own transaction, logging progress as it goes. Every batch is
+// recorded against the import's source, so running the same import again, after it failed part way or not,
+// only writes the batches that are missing.
+type importer struct {
+	app   *application
+	ctx   context.Context
+	batch database.ImportBatch
+
+	total, pending, done, skipped int
+	lastProgress                  time.Time
+}
+
+// newImporter starts an import identified by source, a hash of everything it was read from. Total is how
+// many rows it will write, for the progress.
+func (app *application) newImporter(ctx context.Context, source string, merge database.MergeMode, total int) *importer {
+	return &importer{
+		app:          app,
+		ctx:          ctx,
+		batch:        database.ImportBatch{Source: source, Merge: merge, Size: app.config.importing.batchSize},
+		total:        total,
+		lastProgress: time.Now(),
+	}
+}
+
+func (im *importer) add(record importRecord) error {
+	switch {
+	case record.site != nil:
+		im.batch.Sites = append(im.batch.Sites, *record.site)
+	case record.rollup != nil:
+		im.batch.Rollups = append(im.batch.Rollups, *record.rollup)
+	default:
+		im.batch.Reactions = append(im.batch.Reactions, *record.reaction)
+	}
+	im.pending += record.size()
+
+	if im.pending >= im.batch.Size {
+		return im.write()
+	}
+	return nil
+}
+
+// finish writes what's left, and reports how the import went
+func (im *importer) finish() error {
+	if len(im.batch.Sites) > 0 || len(im.batch.Rollups) > 0 || len(im.batch.Reactions) > 0 {
+		err := im.write()
+		if err != nil {
+			return err
+		}
+	}
+
+	im.app.logger.Info("imported", "records", im.done, "batches", im.batch.Number, "already_imported", im.skipped, "merge", string(im.batch.Merge))
+	return nil
+}
+
+func (im *importer) write() error {
+	applied, err := im.app.db.Import(im.ctx, im.batch)
+	if err != nil {
+		return fmt.Errorf("importing batch %d: %w", im.batch.Number, err)
+	}
+	if !applied {
+		im.skipped++
+	}
+
+	im.done += im.pending
+	im.pending = 0
+	im.batch.Number++
+	im.batch.Sites, im.batch.Rollups, im.batch.Reactions = nil, nil, nil
+
+	if time.Since(im.lastProgress) >= importProgressInterval {
+		im.lastProgress = time.Now()
+		im.app.logger.Info("importing", "records", im.done, "total", im.total, "percent", im.done*100/im.total)
+	}
+	return nil
+}
+
+// openImport opens the file to import from. Stdin is copied to a temporary file first, as it's read twice.
+func openImport(path string) (*os.File, error) {
+	if path != "-" {
+		return os.Open(path)
+	}
+
+	spool, err := os.CreateTemp("", "openheart-import-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays around until it's closed
+	os.Remove(spool.Name())
+
+	_, err = io.Copy(spool, os.Stdin)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// size is how many rows a record writes, which batches are sized by
+func (record importRecord) size() int {
+	if record.site != nil {
+		return max(len(record.site.Counts), 1)
+	}
+	return 1
+}
+
+// readRecords calls fn with every record in an import, after checking it the way a reaction would be
+func readRecords(r io.Reader, format string, fn func(importRecord) error) error {
+	if format == formatCSV {
+		return readCSV(r, fn)
+	}
+	return readJSONL(r, fn)
+}
+
+func readJSONL(r io.Reader, fn func(importRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var input struct {
+			Url    string         `json:"url"`
+			Counts map[string]int `json:"counts"`
+			Emoji  string         `json:"emoji"`
+			Time   time.Time      `json:"time"`
+			Day    string         `json:"day"`
+			Count  *int           `json:"count"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&input)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var record importRecord
+		rollup := input.Day != "" || input.Count != nil
+		switch {
+		case input.Counts != nil && input.Emoji == "" && input.Time.IsZero() && !rollup:
+			record.site, err = checkSiteCounts(database.SiteCounts{Url: input.Url, Counts: input.Counts})
+		case input.Counts == nil && input.Emoji != "" && !input.Time.IsZero() && !rollup:
+			record.reaction, err = checkReaction(database.Reaction{Url: input.Url, Emoji: input.Emoji, Time: input.Time})
+		case input.Counts == nil && input.Emoji != "" && input.Time.IsZero() && input.Day != "" && input.Count != nil:
+			record.rollup, err = checkRollup(database.Rollup{Url: input.Url, Emoji: input.Emoji, Day: input.Day, Count: *input.Count})
+		default:
+			err = errors.New("must have either counts, an emoji and a time, or an emoji, a day and a count")
+		}
+		if err == nil {
+			err = fn(record)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func readCSV(r io.Reader, fn func(importRecord) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(header, csvHeader) {
+		return fmt.Errorf("line 1: the header must be %q", csvHeader)
+	}
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+
+		var record importRecord
+		switch row[0] {
+		case "count":
+			var count int
+			count, err = strconv.Atoi(row[3])
+			if err != nil || row[4] != "" {
+				err = errors.New("a count needs a whole number count, and no time")
+				break
+			}
+			record.site, err = checkSiteCounts(database.SiteCounts{Url: row[1], Counts: map[string]int{row[2]: count}})
+		case "reaction":
+			var t time.Time
+			t, err = time.Parse(time.RFC3339, row[4])
+			if err != nil || row[3] != "" {
+				err = errors.New("a reaction needs an RFC 3339 time, and no count")
+				break
+			}
+			record.reaction, err = checkReaction(database.Reaction{Url: row[1], Emoji: row[2], Time: t})
+		case "rollup":
+			var count int
+			count, err = strconv.Atoi(row[3])
+			if err != nil {
+				err = errors.New("a rollup needs a whole number count, and a date as its time")
+				break
+			}
+			record.rollup, err = checkRollup(database.Rollup{Url: row[1], Emoji: row[2], Day: row[4], Count: count})
+		default:
+			err = fmt.Errorf("%q must be count, rollup or reaction", row[0])
+		}
+		if err == nil {
+			err = fn(record)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// checkSiteCounts holds imported counts to the rules reactions follow, returning them with the url as it
+// would be stored
+func checkSiteCounts(site database.SiteCounts) (*database.SiteCounts, error) {
+	parsedUrl, err := request.InputUrl(site.Url).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid url", site.Url)
+	}
+	site.Url = parsedUrl
+
+	for emoji, count := range site.Counts {
+		err = checkEmoji(emoji)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, fmt.Errorf("the count of %s must not be negative", emoji)
+		}
+	}
+
+	return &site, nil
+}
+
+func checkReaction(reaction database.Reaction) (*database.Reaction, error) {
+	parsedUrl, err := request.InputUrl(reaction.Url).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid url", reaction.Url)
+	}
+	reaction.Url = parsedUrl
+
+	err = checkEmoji(reaction.Emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reaction, nil
+}
+
+func checkRollup(rollup database.Rollup) (*database.Rollup, error) {
+	parsedUrl, err := request.InputUrl(rollup.Url).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid url", rollup.Url)
+	}
+	rollup.Url = parsedUrl
+
+	err = checkEmoji(rollup.Emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = time.Parse(time.DateOnly, rollup.Day)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a date, 2006-01-02", rollup.Day)
+	}
+	if rollup.Count < 1 {
+		return nil, fmt.Errorf("the count of %s on %s must be more than 0", rollup.Emoji, rollup.Day)
+	}
+
+	return &rollup, nil
+}
+
+func checkEmoji(emoji string) error {
+	parsed, err := request.ParseEmoji("text/plain", []byte(emoji))
+	if err != nil || parsed.String() != emoji {
+		return fmt.Errorf("%q is not a single emoji", emoji)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	site := database.SiteCounts{Url: "example.com", Counts: map[string]int{"❤️": 3}}
+	rollup := database.Rollup{Url: "example.com", Emoji: "❤️", Day: "2023-05-01", Count: 2}
+	reaction := database.Reaction{Url: "example.com", Emoji: "❤️", Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	want := []importRecord{{site: &site}, {rollup: &rollup}, {reaction: &reaction}}
+
+	for format, newWriter := range map[string]func(*bufio.Writer) exportWriter{formatJSONL: jsonlWriter, formatCSV: csvWriter} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			ew := newWriter(bufio.NewWriter(&buf))
+			err := ew.site(site)
+			if err == nil {
+				err = ew.rollup(rollup)
+			}
+			if err == nil {
+				err = ew.reaction(reaction)
+			}
+			if err == nil {
+				err = ew.flush()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []importRecord
+			err = readRecords(&buf, format, func(record importRecord) error {
+				got = append(got, record)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read back %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadRollupErrors(t *testing.T) {
+	tests := map[string]string{
+		formatJSONL + " with a time":  `{"url":"example.com","emoji":"❤️","day":"2023-05-01","count":2,"time":"2024-05-01T12:00:00Z"}`,
+		formatJSONL + " without day":  `{"url":"example.com","emoji":"❤️","count":2}`,
+		formatJSONL + " bad day":      `{"url":"example.com","emoji":"❤️","day":"May 1st","count":2}`,
+		formatJSONL + " no count":     `{"url":"example.com","emoji":"❤️","day":"2023-05-01","count":0}`,
+		formatCSV + " without count":  "record,url,emoji,count,time\nrollup,example.com,❤️,,2023-05-01",
+		formatCSV + " with full time": "record,url,emoji,count,time\nrollup,example.com,❤️,2,2023-05-01T12:00:00Z",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			format, _, _ := strings.Cut(name, " ")
+			err := readRecords(strings.NewReader(input), format, func(importRecord) error { return nil })
+			if err == nil {
+				t.Error("read without an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/request"
+	"openheart.tylery.com/internal/validator"
+	"openheart.tylery.com/internal/webhook"
+)
+
+const (
+	webhookBatchInterval   = 5 * time.Second
+	webhookPollInterval    = 10 * time.Second
+	webhookDeliveryTimeout = 10 * time.Second
+	webhookDeliveryBatch   = 50
+	webhookMaxAttempts     = 10
+	webhookBaseBackoff     = 10 * time.Second
+	webhookMaxBackoff      = time.Hour
+	webhookEventReactions  = "reactions"
+
+	// How long a claimed delivery is left to the worker that claimed it, which has to outlast the delivery and
+	// recording how it went, so no other worker sends it again meanwhile
+	webhookClaimLease = webhookDeliveryTimeout + 30*time.Second
+)
+
+// The body of every delivery. Reactions is how many reactions landed since the previous delivery,
+// counts are the totals at the time the delivery was queued.
+type webhookPayload struct {
+	Event     string         `json:"event"`
+	Url       string         `json:"url"`
+	Reactions int            `json:"reactions"`
+	Counts    map[string]int `json:"counts"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+// webhookBatch collects the sites that received reactions since the last flush, so a busy page results in
+// one delivery per interval rather than one per reaction
+type webhookBatch struct {
+	mu      sync.Mutex
+	pending map[string]int
+	wake    chan struct{}
+}
+
+func newWebhookBatch() *webhookBatch {
+	return &webhookBatch{
+		pending: map[string]int{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (b *webhookBatch) add(site string) {
+	b.requeue(site, 1)
+}
+
+// requeue puts reactions taken for a flush that failed back, for the next one
+func (b *webhookBatch) requeue(site string, reactions int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending[site] += reactions
+}
+
+// size returns how many sites have reactions waiting for the next flush
+func (b *webhookBatch) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending)
+}
+
+func (b *webhookBatch) take() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := b.pending
+	b.pending = map[string]int{}
+	return pending
+}
+
+func (app *application) startWebhookWorkers(ctx context.Context) {
+	app.backgroundWorker(ctx, "webhook batcher", app.batchWebhooks)
+	app.backgroundWorker(ctx, "webhook deliverer", app.deliverWebhooks)
+}
+
+// batchWebhooks moves batched reactions into the outbox every interval. Once in the outbox they survive
+// a restart, so the last batch is flushed on the way out too.
+func (app *application) batchWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookBatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			app.flushWebhooks(context.WithoutCancel(ctx))
+			return
+		case <-ticker.C:
+			app.flushWebhooks(ctx)
+		}
+	}
+}
+
+// flushWebhooks queues a delivery for every site in the batch. Sites that fail to be queued go back into the
+// batch, so their reactions are part of the next flush rather than lost.
+func (app *application) flushWebhooks(ctx context.Context) {
+	var queued bool
+
+	for site, reactions := range app.webhooks.take() {
+		hasWebhooks, err := app.db.HasWebhooks(ctx, site)
+		if err != nil {
+			app.webhooks.requeue(site, reactions)
+			app.reportBackgroundError("webhook batcher", err)
+			continue
+		}
+		if !hasWebhooks {
+			continue
+		}
+
+		counts, _, err := app.counts(ctx, site)
+		if err != nil {
+			app.webhooks.requeue(site, reactions)
+			app.reportBackgroundError("webhook batcher", err)
+			continue
+		}
+
+		payload, err := json.Marshal(webhookPayload{
+			Event:     webhookEventReactions,
+			Url:       site,
+			Reactions: reactions,
+			Counts:    counts,
+			Timestamp: time.Now().UTC(),
+		})
+		if err != nil {
+			app.reportBackgroundError("webhook batcher", err)
+			continue
+		}
+
+		err = app.db.EnqueueWebhookDeliveries(ctx, site, payload)
+		if err != nil {
+			app.webhooks.requeue(site, reactions)
+			app.reportBackgroundError("webhook batcher", err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case app.webhooks.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliverWebhooks sends whatever is due in the outbox, whenever the batcher queues something new, and on an
+// interval to pick up retries and deliveries queued by other instances
+func (app *application) deliverWebhooks(ctx context.Context) {
+	client := webhook.NewClient(webhookDeliveryTimeout, app.config.webhooks.allowPrivate)
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-app.webhooks.wake:
+		}
+
+		deliveries, err := app.db.DueWebhookDeliveries(ctx, webhookDeliveryBatch)
+		if err != nil {
+			if ctx.Err() == nil {
+				app.reportBackgroundError("webhook deliverer", err)
+			}
+			continue
+		}
+
+		deliverByTarget(ctx, app.config.webhooks.workers, deliveries, func(delivery database.WebhookDelivery) {
+			app.deliverWebhook(ctx, client, delivery)
+		})
+	}
+}
+
+// deliverByTarget delivers to up to workers targets at once, and returns once they're done. Each target gets
+// its deliveries one at a time, in order, so a slow or failing target only holds up its own.
+func deliverByTarget(ctx context.Context, workers int, deliveries []database.WebhookDelivery, deliver func(database.WebhookDelivery)) {
+	var targets []string
+	byTarget := map[string][]database.WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if byTarget[delivery.TargetUrl] == nil {
+			targets = append(targets, delivery.TargetUrl)
+		}
+		byTarget[delivery.TargetUrl] = append(byTarget[delivery.TargetUrl], delivery)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, workers)
+	for _, target := range targets {
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			for _, delivery := range byTarget[target] {
+				if ctx.Err() != nil {
+					return
+				}
+				deliver(delivery)
+			}
+		}()
+	}
+}
+
+func (app *application) deliverWebhook(ctx context.Context, client *http.Client, delivery database.WebhookDelivery) {
+	attempt := delivery.Attempts + 1
+
+	claimed, err := app.db.ClaimWebhookDelivery(ctx, delivery, webhookClaimLease)
+	if err != nil {
+		app.reportBackgroundError("webhook deliverer", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	deliveryErr := webhook.Deliver(ctx, client, delivery.TargetUrl, delivery.Secret, webhookEventReactions, strconv.FormatInt(delivery.Id, 10), delivery.Payload)
+
+	// Record the outcome even if we're shutting down mid delivery
+	ctx = context.WithoutCancel(ctx)
+
+	if deliveryErr == nil {
+		err = app.db.CompleteWebhookDelivery(ctx, delivery.Id)
+	} else {
+		final := attempt >= webhookMaxAttempts
+		app.logger.Warn("webhook delivery failed", "delivery", delivery.Id, "webhook", delivery.WebhookId, "attempt", attempt, "final", final, "error", deliveryErr.Error())
+		err = app.db.FailWebhookDelivery(ctx, delivery.Id, deliveryErr.Error(), webhookBackoff(attempt), final)
+	}
+	if err != nil {
+		app.reportBackgroundError("webhook deliverer", err)
+	}
+}
+
+// webhookBackoff doubles the wait after every failed attempt, 10s, 20s, 40s... up to an hour
+func webhookBackoff(attempt int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempt && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+func (app *application) apiCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Url    string `json:"url"`
+		Target string `json:"target"`
+		Secret string `json:"secret"`
+	}
+
+	err := request.DecodeJSONStrict(w, r, &input)
+	if err != nil {
+		app.apiBadRequest(w, r, err)
+		return
+	}
+
+	parsedUrl, urlErr := request.InputUrl(input.Url).Parse()
+	target, targetErr := url.Parse(input.Target)
+
+	var v validator.Validator
+	v.CheckField(urlErr == nil, "url", "must contain a hostname")
+	v.CheckField(validator.NotBlank(input.Target), "target", "must be provided")
+	v.CheckField(validator.IsURL(input.Target), "target", "must be an absolute URL")
+	v.CheckField(targetErr == nil && validator.In(target.Scheme, "http", "https"), "target", "must be an http or https URL")
+	v.CheckField(validator.MaxRunes(input.Target, 2048), "target", "must not be more than 2048 characters long")
+	if input.Secret != "" {
+		v.CheckField(validator.MinRunes(input.Secret, 16), "secret", "must be at least 16 characters long")
+		v.CheckField(validator.MaxRunes(input.Secret, 128), "secret", "must not be more than 128 characters long")
+	}
+
+	if v.HasErrors() {
+		app.apiFailedValidation(w, r, v)
+		return
+	}
+
+	if input.Secret == "" {
+		input.Secret, err = webhook.NewSecret()
+		if err != nil {
+			app.apiServerError(w, r, err)
+			return
+		}
+	}
+
+	created, err := app.db.InsertWebhook(r.Context(), parsedUrl, input.Target, input.Secret)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	// The secret is only ever shown here, at creation
+	app.apiResponse(w, r, http.StatusCreated, created, nil)
+}
+
+func (app *application) apiListWebhooks(w http.ResponseWriter, r *http.Request) {
+	parsedUrl, err := request.InputUrl(r.URL.Query().Get("url")).Parse()
+	if err != nil {
+		app.apiInvalidUrl(w, r, err)
+		return
+	}
+
+	webhooks, err := app.db.Webhooks(r.Context(), parsedUrl)
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	app.apiResponse(w, r, http.StatusOK, webhooks, nil)
+}
+
+func (app *application) apiDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		app.apiNotFound(w, r)
+		return
+	}
+
+	deleted, err := app.db.DeleteWebhook(r.Context(), id)
+	if errors.Is(err, database.ErrNotFound) {
+		app.apiNotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.apiServerError(w, r, err)
+		return
+	}
+
+	deleted.Secret = ""
+	app.apiResponse(w, r, http.StatusOK, deleted, nil)
+}
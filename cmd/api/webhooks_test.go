@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"openheart.tylery.com/internal/database"
+	"openheart.tylery.com/internal/webhook"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		9:  2560 * time.Second,
+		10: time.Hour,
+	}
+	for attempt, want := range tests {
+		if got := webhookBackoff(attempt); got != want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+// A target that fails is retried through the outbox, backing off in between, until it answers
+func TestWebhookRetriedUntilDelivered(t *testing.T) {
+	const failures = 2
+
+	db := testDatabase(t)
+	ctx := context.Background()
+	app := &application{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if received.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	client := webhook.NewClient(time.Second, true)
+
+	site := fmt.Sprintf("webhook-retry-%d.test", time.Now().UnixNano())
+	hook, err := db.InsertWebhook(ctx, site, srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.DeleteWebhook(ctx, hook.Id)
+		db.ExecContext(ctx, "DELETE FROM site WHERE url=?", site)
+	})
+
+	err = db.EnqueueWebhookDeliveries(ctx, site, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= failures+1; attempt++ {
+		delivery, ok := dueDelivery(t, db, hook.Id)
+		if !ok {
+			t.Fatalf("attempt %d isn't due", attempt)
+		}
+		if delivery.Attempts != attempt-1 {
+			t.Fatalf("attempt %d is due with %d attempts made", attempt, delivery.Attempts)
+		}
+
+		app.deliverWebhook(ctx, client, delivery)
+
+		// The attempt was claimed, so another worker holding the same delivery doesn't send it again
+		claimed, err := db.ClaimWebhookDelivery(ctx, delivery, webhookClaimLease)
+		if err != nil || claimed {
+			t.Fatalf("claimed delivery %d again after attempt %d: %v, %v", delivery.Id, attempt, claimed, err)
+		}
+
+		var row struct {
+			Attempts  int            `db:"attempts"`
+			LastError sql.NullString `db:"last_error"`
+			Delivered bool           `db:"delivered"`
+			RetryIn   float64        `db:"retry_in"`
+		}
+		err = db.GetContext(ctx, &row, `SELECT attempts, last_error, delivered_at IS NOT NULL AS delivered,
+			UNIX_TIMESTAMP(next_attempt_at) - UNIX_TIMESTAMP(NOW()) AS retry_in FROM webhook_outbox WHERE id=?`, delivery.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.Attempts != attempt {
+			t.Errorf("%d attempts recorded after attempt %d", row.Attempts, attempt)
+		}
+
+		if attempt <= failures {
+			backoff := webhookBackoff(attempt).Seconds()
+			if !row.LastError.Valid || row.Delivered || row.RetryIn < backoff-5 || row.RetryIn > backoff {
+				t.Errorf("after failed attempt %d: last error %q, delivered %t, retry in %.0fs, want an error and a retry in %.0fs",
+					attempt, row.LastError.String, row.Delivered, row.RetryIn, backoff)
+			}
+
+			if _, ok := dueDelivery(t, db, hook.Id); ok {
+				t.Fatalf("delivery is due again straight after failed attempt %d", attempt)
+			}
+			// Rather than wait out the backoff, bring the retry forward
+			_, err = db.ExecContext(ctx, "UPDATE webhook_outbox SET next_attempt_at=NOW() WHERE id=?", delivery.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if !row.Delivered {
+			t.Errorf("not delivered after attempt %d", attempt)
+		}
+	}
+
+	if got := received.Load(); got != failures+1 {
+		t.Errorf("target received %d deliveries, want %d", got, failures+1)
+	}
+	if _, ok := dueDelivery(t, db, hook.Id); ok {
+		t.Error("delivery is still due once delivered")
+	}
+}
+
+// dueDelivery returns the delivery due for a webhook, if any
+func dueDelivery(t *testing.T, db *database.DB, webhookId int) (database.WebhookDelivery, bool) {
+	t.Helper()
+
+	deliveries, err := db.DueWebhookDeliveries(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, delivery := range deliveries {
+		if delivery.WebhookId == webhookId {
+			return delivery, true
+		}
+	}
+	return database.WebhookDelivery{}, false
+}
+
+// Sites that can't be queued stay in the batch for the next flush
+func TestFlushWebhooksKeepsFailedSites(t *testing.T) {
+	db, err := database.Open("root@tcp(127.0.0.1:1)/db?timeout=1s", database.PoolConfig{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := &application{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), webhooks: newWebhookBatch()}
+	app.webhooks.add("example.com")
+	app.webhooks.add("example.com")
+
+	app.flushWebhooks(context.Background())
+
+	pending := app.webhooks.take()
+	if pending["example.com"] != 2 {
+		t.Errorf("batch holds %v after a failed flush, want example.com with its 2 reactions", pending)
+	}
+}
+
+func TestDeliverByTarget(t *testing.T) {
+	const workers = 2
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	targetInFlight := map[string]int{}
+	delivered := map[string][]int64{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		targetInFlight[r.URL.Path]++
+		maxInFlight = max(maxInFlight, inFlight)
+		if targetInFlight[r.URL.Path] > 1 {
+			t.Errorf("%s was delivered to more than once at a time", r.URL.Path)
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		targetInFlight[r.URL.Path]--
+		id, _ := strconv.ParseInt(r.Header.Get(webhook.DeliveryHeader), 10, 64)
+		delivered[r.URL.Path] = append(delivered[r.URL.Path], id)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	client := webhook.NewClient(time.Second, true)
+
+	var deliveries []database.WebhookDelivery
+	for i := range 12 {
+		deliveries = append(deliveries, database.WebhookDelivery{Id: int64(i), TargetUrl: fmt.Sprintf("%s/%d", srv.URL, i%4)})
+	}
+
+	deliverByTarget(context.Background(), workers, deliveries, func(delivery database.WebhookDelivery) {
+		err := webhook.Deliver(context.Background(), client, delivery.TargetUrl, "secret", webhookEventReactions, strconv.FormatInt(delivery.Id, 10), nil)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	if maxInFlight != workers {
+		t.Errorf("%d deliveries were in flight at once, want %d", maxInFlight, workers)
+	}
+	for target := range 4 {
+		got := delivered[fmt.Sprintf("/%d", target)]
+		want := []int64{int64(target), int64(target + 4), int64(target + 8)}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("target %d was delivered %v, want %v in order", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package badge
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+type Count struct {
+	Emoji string
+	Count int
+}
+
+type Theme struct {
+	Label string
+	Value string
+	Text  string
+}
+
+var Themes = map[string]Theme{
+	"light": {Label: "#555", Value: "#e94e77", Text: "#fff"},
+	"dark":  {Label: "#222", Value: "#9c2f55", Text: "#eee"},
+}
+
+type Options struct {
+	Label   string
+	Theme   Theme
+	Compact bool
+}
+
+const (
+	height      = 20
+	padding     = 6
+	fontSize    = 11
+	charWidth   = 7
+	emojiWidth  = 14
+	separator   = " · "
+	emptyValue  = "no reactions yet"
+	fontFamily  = "Verdana,Geneva,DejaVu Sans,sans-serif"
+	textOffsetY = 14
+)
+
+// Top sorts counts by count, highest first, and returns at most n of them. Ties are broken by emoji, so
+// the same counts always render the same badge.
+func Top(counts map[string]int, n int) []Count {
+	top := make([]Count, 0, len(counts))
+	for emoji, count := range counts {
+		top = append(top, Count{Emoji: emoji, Count: count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Emoji < top[j].Emoji
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// FormatCount renders a count, optionally compacted to 1.2k, 3.4M and so on. Counts are rounded before they're
+// given a unit, so one that rounds up to a thousand of a unit carries to the next, as 999950 is 1M.
+func FormatCount(n int, compact bool) string {
+	if !compact || n < 1000 {
+		return strconv.Itoa(n)
+	}
+
+	units := []struct {
+		size   int64
+		suffix string
+	}{{1e3, "k"}, {1e6, "M"}, {1e9, "B"}}
+
+	count := int64(n)
+	i := 0
+	for i+1 < len(units) && count >= units[i+1].size {
+		i++
+	}
+	for ; ; i++ {
+		unit := units[i]
+
+		// Below a hundred of the unit there's room for a decimal
+		tenths := (count*10 + unit.size/2) / unit.size
+		if tenths < 1000 {
+			if tenths%10 == 0 {
+				return strconv.FormatInt(tenths/10, 10) + unit.suffix
+			}
+			return fmt.Sprintf("%d.%d%s", tenths/10, tenths%10, unit.suffix)
+		}
+
+		whole := (count + unit.size/2) / unit.size
+		if whole < 1000 || i == len(units)-1 {
+			return strconv.FormatInt(whole, 10) + unit.suffix
+		}
+	}
+}
+
+// Value renders counts the way they appear on the right of the badge, e.g. "💖 5 · 👍 3"
+func Value(counts []Count, compact bool) string {
+	if len(counts) == 0 {
+		return emptyValue
+	}
+
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = c.Emoji + " " + FormatCount(c.Count, compact)
+	}
+	return strings.Join(parts, separator)
+}
+
+// Render returns a shields.io style SVG badge, with the label on the left and the counts on the right
+func Render(counts []Count, opts Options) []byte {
+	return RenderText(opts.Label, Value(counts, opts.Compact), opts.Theme)
+}
+
+func RenderText(label string, value string, theme Theme) []byte {
+	labelWidth := textWidth(label) + 2*padding
+	valueWidth := textWidth(value) + 2*padding
+	width := labelWidth + valueWidth
+
+	title := html.EscapeString(label + ": " + value)
+	label = html.EscapeString(label)
+	value = html.EscapeString(value)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img" aria-label="%s">`, width, height, title)
+	fmt.Fprintf(&b, `<title>%s</title>`, title)
+	b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="%d" rx="3" fill="#fff"/></clipPath>`, width, height)
+	fmt.Fprintf(&b, `<g clip-path="url(#r)"><rect width="%d" height="%d" fill="%s"/><rect x="%d" width="%d" height="%d" fill="%s"/><rect width="%d" height="%d" fill="url(#s)"/></g>`,
+		labelWidth, height, theme.Label, labelWidth, valueWidth, height, theme.Value, width, height)
+	fmt.Fprintf(&b, `<g fill="%s" text-anchor="middle" font-family="%s" font-size="%d">`, theme.Text, fontFamily, fontSize)
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, labelWidth/2, textOffsetY, label)
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, labelWidth+valueWidth/2, textOffsetY, value)
+	b.WriteString(`</g></svg>`)
+
+	return b.Bytes()
+}
+
+// textWidth estimates the rendered width of text. Without the font metrics this can't be exact, but
+// a fixed width per character, and double that for emoji, is close enough for Verdana at 11px.
+func textWidth(text string) int {
+	var width int
+
+	graphemes := uniseg.NewGraphemes(text)
+	for graphemes.Next() {
+		cluster := graphemes.Str()
+		r, _ := utf8.DecodeRuneInString(cluster)
+		switch {
+		case r < utf8.RuneSelf:
+			width += charWidth
+		case r == '·':
+			width += charWidth / 2
+		default:
+			width += emojiWidth
+		}
+	}
+
+	return width
+}
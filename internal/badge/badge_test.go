@@ -0,0 +1,32 @@
+package badge
+
+import "testing"
+
+func TestFormatCount(t *testing.T) {
+	tests := map[int]string{
+		0:          "0",
+		999:        "999",
+		1000:       "1k",
+		1049:       "1k",
+		1050:       "1.1k",
+		1234:       "1.2k",
+		99949:      "99.9k",
+		99950:      "100k",
+		100499:     "100k",
+		999499:     "999k",
+		999500:     "1M",
+		999950:     "1M",
+		1250000:    "1.3M",
+		999999999:  "1B",
+		1500000000: "1.5B",
+	}
+	for n, want := range tests {
+		if got := FormatCount(n, true); got != want {
+			t.Errorf("FormatCount(%d) = %q, want %q", n, got, want)
+		}
+	}
+
+	if got := FormatCount(999950, false); got != "999950" {
+		t.Errorf("FormatCount(999950) = %q without compacting, want it whole", got)
+	}
+}
@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is a bounded LRU cache whose entries also expire after a TTL. It is safe for concurrent use.
+type Cache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // Most recently used at the front
+
+	// loads are the keys being loaded from their source, counting the writes to them meanwhile, so a value
+	// loaded before one of them can be recognised as possibly stale
+	loads map[string]*load
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+type load struct {
+	loaders int
+	writes  int
+}
+
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+func New[V any](size int, ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		loads:   map[string]*load{},
+	}
+}
+
+// Get returns the value for a key, if it's cached and hasn't expired. Expired values are kept until they're
+// replaced or evicted, for GetStale.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists || time.Now().After(element.Value.(*entry[V]).expires) {
+		c.misses.Add(1)
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return element.Value.(*entry[V]).value, true
+}
+
+// GetStale returns the value for a key whether it has expired or not, for when there's no source to load a
+// fresh one from
+func (c *Cache[V]) GetStale(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*entry[V]).value, true
+}
+
+// Load fills a key that Get missed from its source, and caches the value fill returns. If the key is updated
+// or deleted while fill runs, the value may already be out of date, so it's returned without being cached.
+// Writes to other keys don't matter.
+func (c *Cache[V]) Load(key string, fill func() (V, error)) (V, error) {
+	c.mu.Lock()
+	l, exists := c.loads[key]
+	if !exists {
+		l = &load{}
+		c.loads[key] = l
+	}
+	l.loaders++
+	writes := l.writes
+	c.mu.Unlock()
+
+	value, err := fill()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l.loaders--
+	if l.loaders == 0 {
+		delete(c.loads, key)
+	}
+	if err == nil && l.writes == writes {
+		c.set(key, value)
+	}
+	return value, err
+}
+
+func (c *Cache[V]) set(key string, value V) {
+	if element, exists := c.entries[key]; exists {
+		element.Value = &entry[V]{key: key, value: value, expires: time.Now().Add(c.ttl)}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry[V]{key: key, value: value, expires: time.Now().Add(c.ttl)})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Update changes a cached value in place. fn is only called when the key is cached, and its result keeps the
+// expiry of the value it replaces.
+func (c *Cache[V]) Update(key string, fn func(V) V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.written(key)
+
+	if element, exists := c.entries[key]; exists {
+		e := element.Value.(*entry[V])
+		e.value = fn(e.value)
+	}
+}
+
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.written(key)
+
+	if element, exists := c.entries[key]; exists {
+		c.remove(element)
+	}
+}
+
+// SetTTL changes how long values cached from now on are kept. Values already cached keep their expiry.
+func (c *Cache[V]) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+func (c *Cache[V]) Stats() Stats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   entries,
+	}
+}
+
+// written marks a key's loads as possibly stale
+func (c *Cache[V]) written(key string) {
+	if l, exists := c.loads[key]; exists {
+		l.writes++
+	}
+}
+
+func (c *Cache[V]) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry[V]).key)
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadCaches(t *testing.T) {
+	c := New[int](10, time.Minute)
+
+	value, err := c.Load("a", func() (int, error) { return 1, nil })
+	if err != nil || value != 1 {
+		t.Fatalf("Load = %d, %v, want 1, nil", value, err)
+	}
+	if value, ok := c.Get("a"); !ok || value != 1 {
+		t.Errorf("Get = %d, %t, want 1, true", value, ok)
+	}
+}
+
+func TestLoadErrorIsNotCached(t *testing.T) {
+	c := New[int](10, time.Minute)
+
+	_, err := c.Load("a", func() (int, error) { return 1, errors.New("unavailable") })
+	if err == nil {
+		t.Fatal("Load didn't return the error")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("a failed load was cached")
+	}
+	if len(c.loads) != 0 {
+		t.Errorf("%d loads left behind", len(c.loads))
+	}
+}
+
+func TestLoadDroppedAfterWriteToKey(t *testing.T) {
+	c := New[int](10, time.Minute)
+
+	value, _ := c.Load("a", func() (int, error) {
+		c.Delete("a")
+		return 1, nil
+	})
+	if value != 1 {
+		t.Errorf("Load = %d, want the loaded value anyway", value)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("a value loaded before a write to its key was cached")
+	}
+}
+
+func TestLoadKeptAfterWriteToOtherKey(t *testing.T) {
+	c := New[int](10, time.Minute)
+
+	c.Load("a", func() (int, error) {
+		c.Update("b", func(v int) int { return v + 1 })
+		c.Delete("c")
+		return 1, nil
+	})
+	if _, ok := c.Get("a"); !ok {
+		t.Error("writes to other keys dropped the loaded value")
+	}
+	if len(c.loads) != 0 {
+		t.Errorf("%d loads left behind", len(c.loads))
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := New[int](2, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Load(key, func() (int, error) { return 1, nil })
+	}
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("the least recently used key wasn't evicted")
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("Stats = %+v, want 1 eviction and 2 entries", stats)
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	c := New[int](10, time.Millisecond)
+	c.Load("a", func() (int, error) { return 1, nil })
+	time.Sleep(2 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get returned an expired value")
+	}
+	if value, ok := c.GetStale("a"); !ok || value != 1 {
+		t.Errorf("GetStale = %d, %t, want the expired value", value, ok)
+	}
+
+	c.Delete("a")
+	if _, ok := c.GetStale("a"); ok {
+		t.Error("GetStale returned a deleted value")
+	}
+}
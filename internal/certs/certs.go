@@ -0,0 +1,92 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Pair is a certificate and its private key, as PEM files
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Store serves certificates by SNI, and reloads them when their files change. It is safe for concurrent use.
+type Store struct {
+	pairs []Pair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+}
+
+// Load reads every pair. The first is served to clients that don't send a server name, or one that none of
+// the certificates cover.
+func Load(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+
+	s := &Store{pairs: pairs}
+	_, err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the pairs again if any of their files changed since they were last read, and reports whether
+// they did. If any pair fails to load, the certificates being served are kept.
+func (s *Store) Reload() (bool, error) {
+	modTimes := make([]time.Time, 0, len(s.pairs)*2)
+	for _, pair := range s.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, err
+			}
+			modTimes = append(modTimes, info.ModTime())
+		}
+	}
+
+	s.mu.RLock()
+	unchanged := slices.EqualFunc(s.modTimes, modTimes, time.Time.Equal)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certs := make([]*tls.Certificate, 0, len(s.pairs))
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return false, fmt.Errorf("loading %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs, s.modTimes = certs, modTimes
+	s.mu.Unlock()
+	return true, nil
+}
+
+// GetCertificate is for tls.Config, picking the first certificate that covers the server name asked for
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
@@ -0,0 +1,170 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names, and its key, to dir
+func writePair(t *testing.T, dir string, names ...string) Pair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := Pair{CertFile: filepath.Join(dir, names[0]+".pem"), KeyFile: filepath.Join(dir, names[0]+".key")}
+	err = os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// served is the name of the certificate the store picks for serverName
+func served(t *testing.T, s *Store, serverName string) string {
+	t.Helper()
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestGetCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Load([]Pair{writePair(t, dir, "example.com"), writePair(t, dir, "example.org", "www.example.org")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]string{
+		"example.com":     "example.com",
+		"www.example.org": "example.org",
+		"example.net":     "example.com",
+		"":                "example.com",
+	} {
+		if got := served(t, s, serverName); got != want {
+			t.Errorf("server name %q was served %s, want %s", serverName, got, want)
+		}
+	}
+}
+
+func TestLoadFails(t *testing.T) {
+	_, err := Load(nil)
+	if err == nil {
+		t.Error("Load succeeded without certificates")
+	}
+
+	dir := t.TempDir()
+	pair := writePair(t, dir, "example.com")
+	pair.KeyFile = writePair(t, dir, "example.org").KeyFile
+	_, err = Load([]Pair{pair})
+	if err == nil {
+		t.Error("Load succeeded with a key that doesn't match its certificate")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writePair(t, dir, "example.com")
+	s, err := Load([]Pair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := s.Reload()
+	if err != nil || reloaded {
+		t.Errorf("Reload = %t, %v without changes, want false, nil", reloaded, err)
+	}
+
+	// A renewal replaces both files, with a new name here so it can be told apart
+	renewed := writePair(t, dir, "renewed.example.com", "example.com")
+	later := time.Now().Add(time.Minute)
+	for from, to := range map[string]string{renewed.CertFile: pair.CertFile, renewed.KeyFile: pair.KeyFile} {
+		err = os.Rename(from, to)
+		if err == nil {
+			err = os.Chtimes(to, later, later)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err = s.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Reload = %t, %v after a renewal, want true, nil", reloaded, err)
+	}
+	if got := served(t, s, "example.com"); got != "renewed.example.com" {
+		t.Errorf("served %s after a renewal, want the renewed certificate", got)
+	}
+}
+
+func TestReloadKeepsServingOnError(t *testing.T) {
+	dir := t.TempDir()
+	pair := writePair(t, dir, "example.com")
+	s, err := Load([]Pair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Half written, as a renewal can be when it's read
+	later := time.Now().Add(time.Minute)
+	err = os.WriteFile(pair.KeyFile, []byte("-----BEGIN"), 0o600)
+	if err == nil {
+		err = os.Chtimes(pair.KeyFile, later, later)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Reload()
+	if err == nil {
+		t.Error("Reload succeeded with a broken key")
+	}
+	if got := served(t, s, "example.com"); got != "example.com" {
+		t.Errorf("served %s after a failed reload, want the certificate from before", got)
+	}
+}
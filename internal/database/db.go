@@ -2,56 +2,251 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
 	"embed"
 	"errors"
 	"fmt"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/source/httpfs"
 	"github.com/jmoiron/sqlx"
-	"log"
+	"io/fs"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/golang-migrate/migrate/v4/database/mysql"
 )
 
-const defaultTimeout = 3 * time.Second
+const (
+	defaultTimeout = 3 * time.Second
+
+	errNoSuchTable = 1146 // ER_NO_SUCH_TABLE
+
+	// Lock names are server wide, so the database's name is hashed into it
+	migrateLockPrefix  = "openheart-migrate-"
+	migrateLockTimeout = 5 * time.Minute
+)
 
 type DB struct {
 	*sqlx.DB
+	dsn string
 }
 
 //go:embed migrations
 var migrations embed.FS
 
-func New(dsn string) (*DB, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-	defer cancel()
+// PoolConfig sizes the connection pool, see the sql.DB methods of the same names
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxIdleTime time.Duration
+	ConnMaxLifetime time.Duration
+}
 
-	db, err := sqlx.ConnectContext(ctx, "mysql", dsn)
+// Open sets up the connection pool without connecting, so the server can start before the database is up.
+// Ping to find out whether it is, then Migrate.
+func Open(dsn string, pool PoolConfig) (*DB, error) {
+	db, err := sqlx.Open("mysql", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxIdleTime(5 * time.Minute)
-	db.SetConnMaxLifetime(2 * time.Hour)
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	return &DB{DB: db, dsn: dsn}, nil
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+// IsConnectionError reports whether err is down to the database not answering, in time or at all, rather than
+// to the query
+func IsConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.As(err, &netErr)
+}
+
+// Migrate brings the schema up to the newest embedded migration. Replicas starting together take turns,
+// so the first one migrates and the rest find nothing left to do.
+func (db *DB) Migrate() error {
+	return db.withMigrator(func(m *migrate.Migrate) error {
+		err := m.Up()
+		if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+			return fmt.Errorf("migrating: %w", err)
+		}
+		return nil
+	})
+}
+
+// MigrateSteps applies the next n migrations, or with a negative n, reverts the last -n
+func (db *DB) MigrateSteps(n int) error {
+	return db.withMigrator(func(m *migrate.Migrate) error {
+		err := m.Steps(n)
+		if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+			return fmt.Errorf("migrating: %w", err)
+		}
+		return nil
+	})
+}
+
+// ForceMigration records the schema as being at version, and no longer dirty, without running anything. It's
+// for after fixing a failed migration by hand.
+func (db *DB) ForceMigration(version int) error {
+	return db.withMigrator(func(m *migrate.Migrate) error {
+		return m.Force(version)
+	})
+}
+
+// withMigrator runs fn while holding an advisory lock on the database's migrations. golang-migrate takes a
+// lock of its own, but only waits 10 seconds for it, and a replica giving up would fail to start while
+// another one runs a long migration.
+func (db *DB) withMigrator(fn func(m *migrate.Migrate) error) error {
+	ctx := context.Background()
+
+	unlock, acquired, err := db.lock(ctx, migrateLockPrefix, migrateLockTimeout)
+	if err != nil {
+		return fmt.Errorf("locking migrations: %w", err)
+	}
+	if !acquired {
+		return fmt.Errorf("locking migrations: still locked by another process after %s", migrateLockTimeout)
+	}
+	defer unlock()
+
+	m, err := db.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	return fn(m)
+}
+
+var errLockFailed = errors.New("the database failed to take the lock")
+
+// lock takes the advisory lock named by prefix, waiting up to timeout for another process to release it.
+// Advisory locks belong to the connection that took them, so it's kept until unlock.
+func (db *DB) lock(ctx context.Context, prefix string, timeout time.Duration) (unlock func(), acquired bool, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// GET_LOCK answers 0 when it timed out waiting, and NULL when it failed, such as when it was killed
+	var result sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(?, MD5(DATABASE())), ?)", prefix, int(timeout.Seconds())).Scan(&result)
+	if err == nil && !result.Valid {
+		err = errLockFailed
+	}
+	if err != nil || result.Int64 != 1 {
+		conn.Close()
+		return nil, false, err
+	}
 
+	unlock = func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(CONCAT(?, MD5(DATABASE())))", prefix)
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+func (db *DB) migrator() (*migrate.Migrate, error) {
 	sourceInstance, err := httpfs.New(http.FS(migrations), "migrations")
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("loading migrations: %w", err)
 	}
-	m, err := migrate.NewWithSourceInstance("httpfs", sourceInstance, fmt.Sprintf("mysql://%s", dsn))
+
+	m, err := migrate.NewWithSourceInstance("httpfs", sourceInstance, fmt.Sprintf("mysql://%s", db.dsn))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("preparing migrations: %w", err)
 	}
-	if err := m.Up(); err != nil {
-		if !errors.Is(err, migrate.ErrNoChange) {
-			log.Fatal(err)
+
+	return m, nil
+}
+
+// LatestMigration returns the version of the newest embedded migration, which is the version a migrated
+// database is expected to be at
+func LatestMigration() (uint, error) {
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest uint
+	for _, entry := range entries {
+		prefix, _, found := strings.Cut(entry.Name(), "_")
+		if !found {
+			continue
+		}
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			continue
 		}
+		latest = max(latest, uint(version))
+	}
+
+	return latest, nil
+}
+
+var (
+	ErrSchemaDirty  = errors.New("the last migration failed part way through, fix it and force the version")
+	ErrSchemaBehind = errors.New("the database isn't migrated to the expected version")
+)
+
+// CheckSchema compares the version the database was migrated to with the newest embedded migration. A newer
+// schema is fine, as during a rolling deploy the new release migrates while the old one is still serving.
+func (db *DB) CheckSchema(ctx context.Context) (version uint, expected uint, err error) {
+	expected, err = LatestMigration()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	version, dirty, err := db.MigrationVersion(ctx)
+	switch {
+	case err != nil:
+		return 0, expected, err
+	case dirty:
+		return version, expected, ErrSchemaDirty
+	case version < expected:
+		return version, expected, ErrSchemaBehind
+	}
+
+	return version, expected, nil
+}
+
+// MigrationVersion returns the version the database was last migrated to. Dirty means that migration failed
+// part way through, and needs fixing by hand.
+func (db *DB) MigrationVersion(ctx context.Context) (_ uint, _ bool, err error) {
+	ctx, span := startSpan(ctx, "MigrationVersion")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var migration struct {
+		Version uint `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+	err = db.GetContext(ctx, &migration, "SELECT version, dirty FROM schema_migrations LIMIT 1")
+	// A database that has never been migrated doesn't have the table yet
+	var mysqlErr *mysql.MySQLError
+	if errors.Is(err, sql.ErrNoRows) || errors.As(err, &mysqlErr) && mysqlErr.Number == errNoSuchTable {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
 	}
 
-	return &DB{db}, nil
+	return migration.Version, migration.Dirty, nil
 }
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"os"
+	"testing"
+)
+
+// testDatabase connects to the database in TEST_DB_DSN, migrated, and skips the test if it isn't set
+func testDatabase(t *testing.T) *DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN isn't set")
+	}
+
+	db, err := Open(dsn, PoolConfig{MaxOpenConns: 8, MaxIdleConns: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,4 @@
+START TRANSACTION;
+DROP TABLE webhook_outbox;
+DROP TABLE webhook;
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,26 @@
+START TRANSACTION;
+CREATE TABLE webhook (
+                        id INT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+                        site_id INT UNSIGNED NOT NULL,
+                        target_url VARCHAR(2048) NOT NULL,
+                        secret VARCHAR(128) NOT NULL,
+                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+                        FOREIGN KEY (site_id) REFERENCES site(id)
+                        ON DELETE CASCADE
+);
+CREATE TABLE webhook_outbox (
+                        id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+                        webhook_id INT UNSIGNED NOT NULL,
+                        payload TEXT NOT NULL,
+                        attempts INT UNSIGNED NOT NULL DEFAULT 0,
+                        next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                        delivered_at TIMESTAMP NULL DEFAULT NULL,
+                        failed_at TIMESTAMP NULL DEFAULT NULL,
+                        last_error VARCHAR(1024) NULL DEFAULT NULL,
+                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                        FOREIGN KEY (webhook_id) REFERENCES webhook(id)
+                        ON DELETE CASCADE,
+                        INDEX pending_idx (delivered_at, failed_at, next_attempt_at)
+);
+COMMIT;
\ No newline at end of file
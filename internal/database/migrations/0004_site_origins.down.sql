@@ -0,0 +1,3 @@
+START TRANSACTION;
+ALTER TABLE site DROP COLUMN allowed_origins;
+COMMIT;
\ No newline at end of file
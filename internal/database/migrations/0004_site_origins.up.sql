@@ -0,0 +1,3 @@
+START TRANSACTION;
+ALTER TABLE site ADD COLUMN allowed_origins VARCHAR(2048) NULL DEFAULT NULL;
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,4 @@
+START TRANSACTION;
+DROP TABLE import_batch;
+DROP TABLE reaction;
+COMMIT;
@@ -0,0 +1,20 @@
+START TRANSACTION;
+CREATE TABLE reaction (
+                        id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+                        site_id INT UNSIGNED NOT NULL,
+                        emoji VARCHAR(128) NOT NULL,
+                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                        FOREIGN KEY (site_id) REFERENCES site(id)
+                        ON DELETE CASCADE,
+                        INDEX site_emoji_created_idx (site_id, emoji, created_at),
+                        INDEX created_idx (created_at)
+);
+CREATE TABLE import_batch (
+                        source CHAR(64) NOT NULL,
+                        merge_mode VARCHAR(16) NOT NULL,
+                        batch_size INT UNSIGNED NOT NULL,
+                        batch INT UNSIGNED NOT NULL,
+                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (source, merge_mode, batch_size, batch)
+);
+COMMIT;
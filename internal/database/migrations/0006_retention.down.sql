@@ -0,0 +1,4 @@
+START TRANSACTION;
+DROP TABLE reaction_rollup;
+DROP TABLE site_archive;
+COMMIT;
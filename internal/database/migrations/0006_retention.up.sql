@@ -0,0 +1,21 @@
+START TRANSACTION;
+CREATE TABLE site_archive (
+                        id INT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+                        url VARCHAR(255) NOT NULL,
+                        counts TEXT NOT NULL,
+                        reactions INT UNSIGNED NOT NULL,
+                        site_created_at TIMESTAMP NULL DEFAULT NULL,
+                        last_active_at TIMESTAMP NULL DEFAULT NULL,
+                        archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                        INDEX url_idx (url)
+);
+CREATE TABLE reaction_rollup (
+                        site_id INT UNSIGNED NOT NULL,
+                        emoji VARCHAR(128) NOT NULL,
+                        day DATE NOT NULL,
+                        count INT UNSIGNED NOT NULL,
+                        PRIMARY KEY (site_id, emoji, day),
+                        FOREIGN KEY (site_id) REFERENCES site(id)
+                        ON DELETE CASCADE
+);
+COMMIT;
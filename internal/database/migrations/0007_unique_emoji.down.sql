@@ -0,0 +1,3 @@
+START TRANSACTION;
+ALTER TABLE emoji DROP INDEX site_emoji_idx;
+COMMIT;
@@ -0,0 +1,10 @@
+START TRANSACTION;
+-- Reactions racing to create the same emoji could each insert a row. Fold any duplicates into the oldest one,
+-- so the unique key can go on.
+UPDATE emoji JOIN (SELECT MIN(id) AS id, SUM(count) AS total FROM emoji GROUP BY site_id, emoji) AS merged
+    ON emoji.id = merged.id
+    SET emoji.count = merged.total;
+DELETE emoji FROM emoji JOIN emoji AS kept
+    ON kept.site_id = emoji.site_id AND kept.emoji = emoji.emoji AND kept.id < emoji.id;
+ALTER TABLE emoji ADD UNIQUE KEY site_emoji_idx (site_id, emoji);
+COMMIT;
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"openheart.tylery.com/internal/request"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// Counts returns the emoji counts for a site, keyed by the decoded emoji.
+// If the site has never received a reaction, ErrNotFound is returned.
+func (db *DB) Counts(ctx context.Context, url string) (map[string]int, error) {
+	counts, _, err := db.CountsModified(ctx, url)
+	return counts, err
+}
+
+// CountsModified returns the emoji counts for a site, like Counts, along with when the most recently
+// updated count changed. A site without any emoji was last modified at the zero time.
+func (db *DB) CountsModified(ctx context.Context, url string) (_ map[string]int, _ time.Time, err error) {
+	ctx, span := startSpan(ctx, "CountsModified")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var urlId request.UrlIdColumn
+	err = db.GetContext(ctx, &urlId, "SELECT id FROM site WHERE url=?", url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// The DSN doesn't ask the driver to parse times, so updated_at comes back as a unix timestamp
+	var emojiRecords []struct {
+		request.EmojiTable
+		UpdatedAt int64 `db:"updated_at"`
+	}
+	err = db.SelectContext(ctx, &emojiRecords, "SELECT id, site_id, emoji, count, UNIX_TIMESTAMP(updated_at) AS updated_at FROM emoji WHERE site_id=? ORDER BY count DESC", urlId)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// We're not interested in revealing all information. We only return the emoji and the count for it
+	counts := make(map[string]int, len(emojiRecords))
+	var modified time.Time
+	for i := range emojiRecords {
+		counts[emojiRecords[i].Emoji.Decode()] = emojiRecords[i].Count
+		if updatedAt := time.Unix(emojiRecords[i].UpdatedAt, 0); updatedAt.After(modified) {
+			modified = updatedAt
+		}
+	}
+
+	return counts, modified, nil
+}
+
+// AddReaction increments the count for an emoji on a site by 1, creating the site
+// and emoji records if they don't exist yet. With record, the reaction is also kept
+// on its own. It returns the new count, and whether the emoji record was created by
+// this call.
+func (db *DB) AddReaction(ctx context.Context, url string, emoji request.EmojiT, record bool) (_ int, _ bool, err error) {
+	ctx, span := startSpan(ctx, "AddReaction")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	urlId, err := ensureSite(ctx, tx, url)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// The record is looked up without locking, as updating a missing row would lock the gap it'd go in, which
+	// concurrent first reactions then deadlock on. Without one, the upsert starts the count at 1, or increments
+	// it if another reaction created the record since. It isn't used every time, as it uses up an auto
+	// increment id even when it updates.
+	var emojiId int
+	var created bool
+	err = tx.GetContext(ctx, &emojiId, "SELECT id FROM emoji WHERE site_id=? AND emoji=?", urlId, emoji.DbEncode())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		result, err := tx.ExecContext(ctx, "INSERT INTO emoji (site_id, emoji) VALUES (?, ?) ON DUPLICATE KEY UPDATE count=count+1", urlId, emoji.DbEncode())
+		if err != nil {
+			return 0, false, err
+		}
+		// One row for an insert, two for an update
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, false, err
+		}
+		created = affected == 1
+	case err != nil:
+		return 0, false, err
+	default:
+		_, err = tx.ExecContext(ctx, "UPDATE emoji SET count=count+1 WHERE id=?", emojiId)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	var count int
+	err = tx.GetContext(ctx, &count, "SELECT count FROM emoji WHERE site_id=? AND emoji=?", urlId, emoji.DbEncode())
+	if err != nil {
+		return 0, false, err
+	}
+
+	// A row for every reaction, with when it was made, for exports. It's the one table that grows with every
+	// reaction rather than every emoji, so it's only kept when asked for.
+	if record {
+		_, err = tx.ExecContext(ctx, "INSERT INTO reaction (site_id, emoji) VALUES (?, ?)", urlId, emoji.DbEncode())
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return count, created, nil
+}
+
+// ensureSite returns the id of the site with the url, creating the site if it doesn't exist yet. Concurrent
+// calls for a new site all get the one row, rather than all but one failing on the unique url.
+func ensureSite(ctx context.Context, tx *sqlx.Tx, url string) (request.UrlIdColumn, error) {
+	var urlId request.UrlIdColumn
+	err := tx.GetContext(ctx, &urlId, "SELECT id FROM site WHERE url=?", url)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return urlId, err
+	}
+
+	// If another call created the site since, LAST_INSERT_ID(id) reports that site's id as the inserted one
+	result, err := tx.ExecContext(ctx, "INSERT INTO site (url) VALUES (?) ON DUPLICATE KEY UPDATE id=LAST_INSERT_ID(id)", url)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return request.UrlIdColumn(id), nil
+}
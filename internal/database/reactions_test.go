@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"openheart.tylery.com/internal/request"
+)
+
+func TestAddReaction(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	site := fmt.Sprintf("add-reaction-%d.test", time.Now().UnixNano())
+	t.Cleanup(func() { db.ExecContext(ctx, "DELETE FROM site WHERE url=?", site) })
+	emoji := request.EmojiT{Bytes: []byte("💖")}
+
+	for i := 1; i <= 3; i++ {
+		count, created, err := db.AddReaction(ctx, site, emoji, i == 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i || created != (i == 1) {
+			t.Errorf("reaction %d counted %d, created %t", i, count, created)
+		}
+	}
+
+	var siteId int
+	err := db.GetContext(ctx, &siteId, "SELECT id FROM site WHERE url=?", site)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last reaction asked to be recorded on its own
+	var recorded int
+	err = db.GetContext(ctx, &recorded, "SELECT COUNT(*) FROM reaction WHERE site_id=?", siteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 1 {
+		t.Errorf("%d reactions recorded, want 1", recorded)
+	}
+
+	// Racing first reactions can't leave a second record behind
+	_, err = db.ExecContext(ctx, "INSERT INTO emoji (site_id, emoji) VALUES (?, ?)", siteId, emoji.DbEncode())
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != errDuplicateEntry {
+		t.Errorf("inserting a second record for an emoji = %v, want a duplicate entry error", err)
+	}
+}
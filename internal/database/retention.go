@@ -0,0 +1,315 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"openheart.tylery.com/internal/request"
+)
+
+const (
+	// Sites are pruned this many at a time, each batch in a transaction of its own
+	pruneBatchSize = 500
+
+	pruneLockPrefix = "openheart-prune-"
+)
+
+// ErrPruneLocked is returned by Prune while another process is pruning the same database
+var ErrPruneLocked = errors.New("another process is pruning the database")
+
+// PrunePolicy decides what Prune removes. Either half is skipped when its time is zero.
+type PrunePolicy struct {
+	// Sites with no more than MaxReactions, and without a reaction since IdleSince, are pruned, and with
+	// Archive kept in site_archive first. Sites with allowed origins or webhooks are never pruned, as someone
+	// set them up.
+	IdleSince    time.Time
+	MaxReactions int
+	Archive      bool
+
+	// Single reactions made before the day of CompactBefore are rolled up into a count for every site, emoji
+	// and day. Days are the database's, in its time zone, so only whole days are compacted.
+	CompactBefore time.Time
+
+	// DryRun reports what would be pruned without changing anything
+	DryRun bool
+}
+
+// StaleSite is a site that's pruned, or would be
+type StaleSite struct {
+	Url        string    `json:"url"`
+	Reactions  int       `json:"reactions"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// PruneReport is what Prune did, or would have done on a dry run
+type PruneReport struct {
+	Sites     []StaleSite `json:"sites"`
+	Reactions int         `json:"reactions"` // Compacted into Rollups
+	Rollups   int         `json:"rollups"`
+}
+
+type staleSite struct {
+	Id         request.UrlIdColumn `db:"id"`
+	Url        string              `db:"url"`
+	Reactions  int                 `db:"reactions"`
+	CreatedAt  int64               `db:"created"`
+	LastActive int64               `db:"last_active"`
+}
+
+// Prune removes stale sites and compacts old reactions, as the policy says. Every batch is written in a
+// transaction of its own, so an interrupted prune keeps what it got through, and the next one carries on.
+func (db *DB) Prune(ctx context.Context, policy PrunePolicy) (_ PruneReport, err error) {
+	ctx, span := startSpan(ctx, "Prune")
+	defer endSpan(span, &err)
+
+	var report PruneReport
+	if !policy.DryRun {
+		unlock, acquired, err := db.lock(ctx, pruneLockPrefix, 0)
+		if err != nil {
+			return report, err
+		}
+		if !acquired {
+			return report, ErrPruneLocked
+		}
+		defer unlock()
+	}
+
+	if !policy.IdleSince.IsZero() {
+		report.Sites, err = db.pruneSites(ctx, policy)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !policy.CompactBefore.IsZero() {
+		report.Reactions, report.Rollups, err = db.compactReactions(ctx, policy)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+func (db *DB) pruneSites(ctx context.Context, policy PrunePolicy) ([]StaleSite, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	// A site is active when it's created, and whenever one of its counts changes
+	var candidates []staleSite
+	err := db.SelectContext(queryCtx, &candidates, `SELECT site.id, site.url, COALESCE(SUM(emoji.count), 0) AS reactions,
+			UNIX_TIMESTAMP(site.created_at) AS created, COALESCE(UNIX_TIMESTAMP(MAX(emoji.updated_at)), 0) AS last_active
+		FROM site LEFT JOIN emoji ON emoji.site_id=site.id
+		WHERE site.allowed_origins IS NULL AND NOT EXISTS (SELECT 1 FROM webhook WHERE webhook.site_id=site.id)
+		GROUP BY site.id, site.url, site.created_at
+		HAVING reactions <= ? AND created < ? AND last_active < ?
+		ORDER BY site.id`, policy.MaxReactions, policy.IdleSince.Unix(), policy.IdleSince.Unix())
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		candidates[i].LastActive = max(candidates[i].LastActive, candidates[i].CreatedAt)
+	}
+
+	var pruned []StaleSite
+	for batch := range slices.Chunk(candidates, pruneBatchSize) {
+		if policy.DryRun {
+			for _, site := range batch {
+				pruned = append(pruned, site.report())
+			}
+			continue
+		}
+
+		sites, err := db.pruneBatch(ctx, batch, policy)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, sites...)
+	}
+
+	return pruned, nil
+}
+
+// pruneBatch deletes a batch of stale sites, along with everything of theirs. Their counts are locked and
+// checked again first, so a site that's been reacted to since it was found is left alone.
+func (db *DB) pruneBatch(ctx context.Context, batch []staleSite, policy PrunePolicy) (_ []StaleSite, err error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sites := map[request.UrlIdColumn]*staleSite{}
+	var ids []request.UrlIdColumn
+	for _, site := range batch {
+		site.Reactions, site.LastActive = 0, site.CreatedAt
+		sites[site.Id] = &site
+		ids = append(ids, site.Id)
+	}
+
+	query, args, err := sqlx.In("SELECT site_id, emoji, count, UNIX_TIMESTAMP(updated_at) FROM emoji WHERE site_id IN (?) FOR UPDATE", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryxContext(ctx, tx.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[request.UrlIdColumn]map[string]int{}
+	for rows.Next() {
+		var siteId request.UrlIdColumn
+		var emoji request.DbEncodedEmoji
+		var count int
+		var updatedAt int64
+		err = rows.Scan(&siteId, &emoji, &count, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		site := sites[siteId]
+		site.Reactions += count
+		site.LastActive = max(site.LastActive, updatedAt)
+		if counts[siteId] == nil {
+			counts[siteId] = map[string]int{}
+		}
+		counts[siteId][emoji.Decode()] += count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []StaleSite
+	ids = ids[:0]
+	for _, site := range batch {
+		checked := sites[site.Id]
+		if checked.Reactions > policy.MaxReactions || checked.LastActive >= policy.IdleSince.Unix() {
+			continue
+		}
+
+		if policy.Archive {
+			siteCounts := counts[site.Id]
+			if siteCounts == nil {
+				siteCounts = map[string]int{}
+			}
+			encoded, err := json.Marshal(siteCounts)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = tx.ExecContext(ctx, `INSERT INTO site_archive (url, counts, reactions, site_created_at, last_active_at)
+				VALUES (?, ?, ?, FROM_UNIXTIME(?), FROM_UNIXTIME(?))`, checked.Url, encoded, checked.Reactions, checked.CreatedAt, checked.LastActive)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ids = append(ids, site.Id)
+		pruned = append(pruned, checked.report())
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err = sqlx.In("DELETE FROM site WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pruned, tx.Commit()
+}
+
+func (site staleSite) report() StaleSite {
+	return StaleSite{Url: site.Url, Reactions: site.Reactions, LastActive: time.Unix(site.LastActive, 0).UTC()}
+}
+
+// compactReactions rolls reactions up a day at a time, oldest first, so no transaction holds more than a
+// day of them. Days are the database's, in its time zone.
+func (db *DB) compactReactions(ctx context.Context, policy PrunePolicy) (reactions int, rollups int, err error) {
+	queryCtx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	// The cut-off goes back to the start of its day, as DATE() has it, so the day it's in isn't rolled up
+	// part way, with the rest of its reactions left behind
+	var before int64
+	err = db.GetContext(queryCtx, &before, "SELECT UNIX_TIMESTAMP(DATE(FROM_UNIXTIME(?)))", policy.CompactBefore.Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if policy.DryRun {
+		return compactable(queryCtx, db.DB, before)
+	}
+
+	for {
+		dayReactions, dayRollups, done, err := db.compactDay(ctx, before)
+		if err != nil || done {
+			return reactions, rollups, err
+		}
+		reactions += dayReactions
+		rollups += dayRollups
+	}
+}
+
+// compactDay compacts the oldest day of reactions made before before, reporting done once there are none
+func (db *DB) compactDay(ctx context.Context, before int64) (reactions int, rollups int, done bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer tx.Rollback()
+
+	var next sql.NullInt64
+	err = tx.GetContext(ctx, &next, "SELECT UNIX_TIMESTAMP(DATE(MIN(created_at)) + INTERVAL 1 DAY) FROM reaction WHERE created_at < FROM_UNIXTIME(?)", before)
+	if err != nil || !next.Valid {
+		return 0, 0, true, err
+	}
+	end := min(next.Int64, before)
+
+	reactions, rollups, err = compactable(ctx, tx, end)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO reaction_rollup (site_id, emoji, day, count)
+		SELECT * FROM (
+			SELECT site_id, emoji, DATE(created_at) AS day, COUNT(*) AS reactions FROM reaction WHERE created_at < FROM_UNIXTIME(?) GROUP BY site_id, emoji, DATE(created_at)
+		) AS days
+		ON DUPLICATE KEY UPDATE count=count+days.reactions`, end)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM reaction WHERE created_at < FROM_UNIXTIME(?)", end)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return reactions, rollups, false, tx.Commit()
+}
+
+// compactable counts the reactions made before before, and the rollups they'd make
+func compactable(ctx context.Context, q sqlx.QueryerContext, before int64) (reactions int, rollups int, err error) {
+	err = q.QueryRowxContext(ctx, `SELECT COALESCE(SUM(reactions), 0), COUNT(*) FROM (
+			SELECT COUNT(*) AS reactions FROM reaction WHERE created_at < FROM_UNIXTIME(?) GROUP BY site_id, emoji, DATE(created_at)
+		) AS rollups`, before).Scan(&reactions, &rollups)
+	return reactions, rollups, err
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"openheart.tylery.com/internal/request"
+)
+
+// A dry run reports the stale site and the reactions on whole days before the cut-off, without changing them
+func TestPruneDryRun(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	// Days are the database's, so every time is worked out by it: the cut-off is noon five days ago
+	var cutoff int64
+	err := db.GetContext(ctx, &cutoff, "SELECT UNIX_TIMESTAMP(DATE(NOW()) - INTERVAL 5 DAY + INTERVAL 12 HOUR)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := PrunePolicy{IdleSince: time.Unix(cutoff, 0), MaxReactions: 10, CompactBefore: time.Unix(cutoff, 0), DryRun: true}
+
+	// Whatever the database has already is reported too
+	baseline, err := db.Prune(ctx, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := fmt.Sprintf("prune-%d.test", time.Now().UnixNano())
+	t.Cleanup(func() { db.ExecContext(ctx, "DELETE FROM site WHERE url=?", site) })
+	heart, party := request.EmojiT{Bytes: []byte("💖")}.DbEncode(), request.EmojiT{Bytes: []byte("🎉")}.DbEncode()
+
+	result, err := db.ExecContext(ctx, "INSERT INTO site (url, created_at) VALUES (?, NOW() - INTERVAL 30 DAY)", site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteId, _ := result.LastInsertId()
+
+	for _, statement := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO emoji (site_id, emoji, count, updated_at) VALUES (?, ?, 4, NOW() - INTERVAL 10 DAY)", []any{siteId, heart}},
+		{"INSERT INTO emoji (site_id, emoji, count, updated_at) VALUES (?, ?, 1, NOW() - INTERVAL 7 DAY)", []any{siteId, party}},
+		// Two rollups' worth on whole days before the cut-off
+		{"INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, DATE(NOW()) - INTERVAL 7 DAY + INTERVAL 10 HOUR)", []any{siteId, heart}},
+		{"INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, DATE(NOW()) - INTERVAL 7 DAY + INTERVAL 11 HOUR)", []any{siteId, heart}},
+		{"INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, DATE(NOW()) - INTERVAL 6 DAY + INTERVAL 9 HOUR)", []any{siteId, party}},
+		// On the cut-off's day, before and after it, which isn't over yet
+		{"INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, DATE(NOW()) - INTERVAL 5 DAY + INTERVAL 1 HOUR)", []any{siteId, heart}},
+		{"INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, DATE(NOW()) - INTERVAL 5 DAY + INTERVAL 23 HOUR)", []any{siteId, heart}},
+	} {
+		_, err = db.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lastActive int64
+	err = db.GetContext(ctx, &lastActive, "SELECT UNIX_TIMESTAMP(MAX(updated_at)) FROM emoji WHERE site_id=?", siteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.Prune(ctx, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reactions, rollups := report.Reactions-baseline.Reactions, report.Rollups-baseline.Rollups; reactions != 3 || rollups != 2 {
+		t.Errorf("would compact %d more reactions into %d more rollups, want 3 into 2", reactions, rollups)
+	}
+
+	var found bool
+	for _, stale := range report.Sites {
+		if stale.Url != site {
+			continue
+		}
+		found = true
+		if stale.Reactions != 5 || !stale.LastActive.Equal(time.Unix(lastActive, 0)) {
+			t.Errorf("reported %+v, want 5 reactions, last active %s", stale, time.Unix(lastActive, 0).UTC())
+		}
+	}
+	if !found {
+		t.Errorf("%s isn't among the sites that would be pruned", site)
+	}
+
+	var sites, reactions, rollups int
+	err = db.GetContext(ctx, &sites, "SELECT COUNT(*) FROM site WHERE id=?", siteId)
+	if err == nil {
+		err = db.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM reaction WHERE site_id=?", siteId)
+	}
+	if err == nil {
+		err = db.GetContext(ctx, &rollups, "SELECT COUNT(*) FROM reaction_rollup WHERE site_id=?", siteId)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sites != 1 || reactions != 5 || rollups != 0 {
+		t.Errorf("the dry run left %d sites, %d reactions and %d rollups, want 1, 5 and 0", sites, reactions, rollups)
+	}
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Site is the policy for a site. Without any allowed origins, any origin may react to it.
+type Site struct {
+	Url     string   `json:"url"`
+	Origins []string `json:"origins"`
+}
+
+// AllowedOrigins returns the origins that may react to a site from a browser. Nil means there's no
+// restriction. If the site doesn't exist, ErrNotFound is returned.
+func (db *DB) AllowedOrigins(ctx context.Context, url string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "AllowedOrigins")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var allowedOrigins sql.NullString
+	err = db.GetContext(ctx, &allowedOrigins, "SELECT allowed_origins FROM site WHERE url=?", url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Origins can't contain spaces, so they're stored space separated
+	return strings.Fields(allowedOrigins.String), nil
+}
+
+// SetAllowedOrigins replaces the origins that may react to a site, creating the site if it doesn't exist yet.
+// No origins lifts the restriction.
+func (db *DB) SetAllowedOrigins(ctx context.Context, url string, origins []string) (_ Site, err error) {
+	ctx, span := startSpan(ctx, "SetAllowedOrigins")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Site{}, err
+	}
+	defer tx.Rollback()
+
+	urlId, err := ensureSite(ctx, tx, url)
+	if err != nil {
+		return Site{}, err
+	}
+
+	allowedOrigins := sql.NullString{String: strings.Join(origins, " "), Valid: len(origins) > 0}
+	_, err = tx.ExecContext(ctx, "UPDATE site SET allowed_origins=? WHERE id=?", allowedOrigins, urlId)
+	if err != nil {
+		return Site{}, err
+	}
+
+	if origins == nil {
+		origins = []string{}
+	}
+	return Site{Url: url, Origins: origins}, tx.Commit()
+}
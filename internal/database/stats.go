@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"openheart.tylery.com/internal/request"
+)
+
+// Stats add up every count, which takes longer than looking up a single site
+const statsTimeout = 30 * time.Second
+
+type Totals struct {
+	Sites     int `db:"sites" json:"sites"`
+	Reactions int `db:"reactions" json:"reactions"`
+}
+
+type SiteTotal struct {
+	Url       string `db:"url" json:"url"`
+	Reactions int    `db:"reactions" json:"reactions"`
+}
+
+type EmojiTotal struct {
+	Emoji     string `json:"emoji"`
+	Reactions int    `json:"reactions"`
+	Sites     int    `json:"sites"`
+}
+
+// Totals returns how many sites have been reacted to, and how many reactions they've had between them
+func (db *DB) Totals(ctx context.Context) (_ Totals, err error) {
+	ctx, span := startSpan(ctx, "Totals")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	var totals Totals
+	err = db.GetContext(ctx, &totals, "SELECT COUNT(DISTINCT site_id) AS sites, COALESCE(SUM(count), 0) AS reactions FROM emoji")
+	return totals, err
+}
+
+// TopSites returns the sites with the most reactions, most first
+func (db *DB) TopSites(ctx context.Context, limit int) (_ []SiteTotal, err error) {
+	ctx, span := startSpan(ctx, "TopSites")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	var sites []SiteTotal
+	err = db.SelectContext(ctx, &sites, `SELECT site.url, SUM(emoji.count) AS reactions FROM site JOIN emoji ON emoji.site_id=site.id
+		GROUP BY site.id, site.url ORDER BY reactions DESC, site.url LIMIT ?`, limit)
+	return sites, err
+}
+
+// TopEmoji returns the emoji used the most across every site, most first, along with how many sites use them
+func (db *DB) TopEmoji(ctx context.Context, limit int) (_ []EmojiTotal, err error) {
+	ctx, span := startSpan(ctx, "TopEmoji")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+
+	var records []struct {
+		Emoji     request.DbEncodedEmoji `db:"emoji"`
+		Reactions int                    `db:"reactions"`
+		Sites     int                    `db:"sites"`
+	}
+	err = db.SelectContext(ctx, &records, `SELECT emoji, SUM(count) AS reactions, COUNT(DISTINCT site_id) AS sites FROM emoji
+		GROUP BY emoji ORDER BY reactions DESC, emoji LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	emoji := make([]EmojiTotal, 0, len(records))
+	for _, record := range records {
+		emoji = append(emoji, EmojiTotal{Emoji: record.Emoji.Decode(), Reactions: record.Reactions, Sites: record.Sites})
+	}
+	return emoji, nil
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The global tracer provider is only set up after the database is, so the tracer is looked up for every
+// span rather than once
+func tracer() trace.Tracer {
+	return otel.Tracer("openheart.tylery.com/internal/database")
+}
+
+// startSpan starts a span for a store call. It's ended with endSpan, which records the error the call
+// returned, if any.
+//
+//	ctx, span := startSpan(ctx, "Counts")
+//	defer endSpan(span, &err)
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "database."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "mysql")),
+	)
+}
+
+func endSpan(span trace.Span, err *error) {
+	// Not finding a record is an answer rather than a failure
+	if *err != nil && *err != ErrNotFound {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
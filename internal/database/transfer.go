@@ -0,0 +1,327 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"openheart.tylery.com/internal/request"
+)
+
+// A batch writes many rows in one transaction, which takes longer than a single reaction
+const batchTimeout = 30 * time.Second
+
+const errDuplicateEntry = 1062 // ER_DUP_ENTRY
+
+// SiteCounts is every emoji count of a site, keyed by the decoded emoji, as it's exported and imported
+type SiteCounts struct {
+	Url    string         `json:"url"`
+	Counts map[string]int `json:"counts"`
+}
+
+// Reaction is a single reaction, as it's exported and imported. Times only go down to the second.
+type Reaction struct {
+	Url   string    `json:"url"`
+	Emoji string    `json:"emoji"`
+	Time  time.Time `json:"time"`
+}
+
+// Rollup is a day of reactions to an emoji on a site, after compaction, as it's exported and imported. Day is
+// the date, 2006-01-02, in the database's time zone.
+type Rollup struct {
+	Url   string `json:"url"`
+	Emoji string `json:"emoji"`
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// Merge modes decide what an imported count does to the count already there
+type MergeMode string
+
+const (
+	MergeSum     MergeMode = "sum"     // Added to it
+	MergeReplace MergeMode = "replace" // Replaces it
+	MergeMax     MergeMode = "max"     // Replaces it if it's higher
+)
+
+// ImportBatch is part of an import, written in a transaction of its own. Source identifies the import, and
+// together with the merge mode, the batch size and the batch's number, the batch, so it's only ever applied
+// once however many times the import is run.
+type ImportBatch struct {
+	Source    string
+	Merge     MergeMode
+	Size      int
+	Number    int
+	Sites     []SiteCounts
+	Rollups   []Rollup
+	Reactions []Reaction
+}
+
+// ExportCounts calls fn with the counts of every site that has any, in order of url. The sites are read in a
+// single pass, so there's no timeout beyond ctx's own.
+func (db *DB) ExportCounts(ctx context.Context, fn func(SiteCounts) error) (err error) {
+	ctx, span := startSpan(ctx, "ExportCounts")
+	defer endSpan(span, &err)
+
+	rows, err := db.QueryxContext(ctx, "SELECT site.url, emoji.emoji, emoji.count FROM site JOIN emoji ON emoji.site_id=site.id ORDER BY site.url, emoji.id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var site SiteCounts
+	for rows.Next() {
+		var url string
+		var emoji request.DbEncodedEmoji
+		var count int
+		err = rows.Scan(&url, &emoji, &count)
+		if err != nil {
+			return err
+		}
+
+		if url != site.Url {
+			if site.Url != "" {
+				err = fn(site)
+				if err != nil {
+					return err
+				}
+			}
+			site = SiteCounts{Url: url, Counts: map[string]int{}}
+		}
+		site.Counts[emoji.Decode()] += count
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	if site.Url != "" {
+		return fn(site)
+	}
+	return nil
+}
+
+// ExportReactions calls fn with every reaction, oldest first, like ExportCounts
+func (db *DB) ExportReactions(ctx context.Context, fn func(Reaction) error) (err error) {
+	ctx, span := startSpan(ctx, "ExportReactions")
+	defer endSpan(span, &err)
+
+	rows, err := db.QueryxContext(ctx, "SELECT site.url, reaction.emoji, UNIX_TIMESTAMP(reaction.created_at) FROM reaction JOIN site ON site.id=reaction.site_id ORDER BY reaction.id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string
+		var emoji request.DbEncodedEmoji
+		var createdAt int64
+		err = rows.Scan(&url, &emoji, &createdAt)
+		if err != nil {
+			return err
+		}
+
+		err = fn(Reaction{Url: url, Emoji: emoji.Decode(), Time: time.Unix(createdAt, 0).UTC()})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ExportRollups calls fn with every rollup, oldest day first, like ExportCounts
+func (db *DB) ExportRollups(ctx context.Context, fn func(Rollup) error) (err error) {
+	ctx, span := startSpan(ctx, "ExportRollups")
+	defer endSpan(span, &err)
+
+	rows, err := db.QueryxContext(ctx, "SELECT site.url, reaction_rollup.emoji, DATE_FORMAT(reaction_rollup.day, '%Y-%m-%d'), reaction_rollup.count FROM reaction_rollup JOIN site ON site.id=reaction_rollup.site_id ORDER BY reaction_rollup.day, site.url, reaction_rollup.emoji")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rollup Rollup
+		var emoji request.DbEncodedEmoji
+		err = rows.Scan(&rollup.Url, &emoji, &rollup.Day, &rollup.Count)
+		if err != nil {
+			return err
+		}
+		rollup.Emoji = emoji.Decode()
+
+		err = fn(rollup)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Import writes a batch of counts and reactions, creating the sites and emoji that don't exist yet. It
+// reports false without writing anything when the batch has been imported before.
+//
+// Counts are merged into the ones there are by the batch's merge mode, and emoji without an imported count
+// keep theirs. Reactions are only added as far as there aren't as many of them at the same time already, so
+// they don't change the counts, and importing them into the instance they came from adds none. Reactions on a
+// day that's been compacted are left out, as its rollup has them already.
+//
+// Rollups are written before reactions, and compact the day they're for as prune would: the day's reactions
+// to the emoji on the site are folded into its rollup, which is kept at the imported count if that's higher.
+// Like reactions, they never change the counts, and importing them again adds nothing.
+func (db *DB) Import(ctx context.Context, batch ImportBatch) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "Import")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO import_batch (source, merge_mode, batch_size, batch) VALUES (?, ?, ?, ?)", batch.Source, batch.Merge, batch.Size, batch.Number)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	siteIds := map[string]request.UrlIdColumn{}
+	siteId := func(url string) (request.UrlIdColumn, error) {
+		id, found := siteIds[url]
+		if found {
+			return id, nil
+		}
+		id, err := ensureSite(ctx, tx, url)
+		siteIds[url] = id
+		return id, err
+	}
+
+	for _, site := range batch.Sites {
+		urlId, err := siteId(site.Url)
+		if err != nil {
+			return false, err
+		}
+
+		for emoji, count := range site.Counts {
+			err = mergeCount(ctx, tx, urlId, request.EmojiT{Bytes: []byte(emoji)}.DbEncode(), count, batch.Merge)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for _, rollup := range batch.Rollups {
+		urlId, err := siteId(rollup.Url)
+		if err != nil {
+			return false, err
+		}
+
+		err = mergeRollup(ctx, tx, urlId, rollup)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Reactions in the same second can only be told apart by how many of them there are
+	type reactionKey struct {
+		url   string
+		emoji string
+		time  int64
+	}
+	reactions := map[reactionKey]int{}
+	var keys []reactionKey
+	for _, reaction := range batch.Reactions {
+		key := reactionKey{reaction.Url, request.EmojiT{Bytes: []byte(reaction.Emoji)}.DbEncode(), reaction.Time.Unix()}
+		if reactions[key] == 0 {
+			keys = append(keys, key)
+		}
+		reactions[key]++
+	}
+
+	for _, key := range keys {
+		urlId, err := siteId(key.url)
+		if err != nil {
+			return false, err
+		}
+
+		var rolledUp bool
+		err = tx.GetContext(ctx, &rolledUp, "SELECT EXISTS (SELECT 1 FROM reaction_rollup WHERE site_id=? AND emoji=? AND day=DATE(FROM_UNIXTIME(?)))", urlId, key.emoji, key.time)
+		if err != nil {
+			return false, err
+		}
+		if rolledUp {
+			continue
+		}
+
+		var existing int
+		err = tx.GetContext(ctx, &existing, "SELECT COUNT(*) FROM reaction WHERE site_id=? AND emoji=? AND created_at=FROM_UNIXTIME(?)", urlId, key.emoji, key.time)
+		if err != nil {
+			return false, err
+		}
+
+		for range reactions[key] - existing {
+			_, err = tx.ExecContext(ctx, "INSERT INTO reaction (site_id, emoji, created_at) VALUES (?, ?, FROM_UNIXTIME(?))", urlId, key.emoji, key.time)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func mergeCount(ctx context.Context, tx *sqlx.Tx, urlId request.UrlIdColumn, emoji string, count int, merge MergeMode) error {
+	var emojiId int
+	err := tx.GetContext(ctx, &emojiId, "SELECT id FROM emoji WHERE site_id=? AND emoji=? FOR UPDATE", urlId, emoji)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(ctx, "INSERT INTO emoji (site_id, emoji, count) VALUES (?, ?, ?)", urlId, emoji, count)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	switch merge {
+	case MergeSum:
+		_, err = tx.ExecContext(ctx, "UPDATE emoji SET count=count+? WHERE id=?", count, emojiId)
+	case MergeMax:
+		_, err = tx.ExecContext(ctx, "UPDATE emoji SET count=GREATEST(count, ?) WHERE id=?", count, emojiId)
+	default:
+		_, err = tx.ExecContext(ctx, "UPDATE emoji SET count=? WHERE id=?", count, emojiId)
+	}
+	return err
+}
+
+func mergeRollup(ctx context.Context, tx *sqlx.Tx, urlId request.UrlIdColumn, rollup Rollup) error {
+	emoji := request.EmojiT{Bytes: []byte(rollup.Emoji)}.DbEncode()
+
+	var rolledUp, reactions int
+	err := tx.GetContext(ctx, &rolledUp, "SELECT COALESCE(SUM(count), 0) FROM reaction_rollup WHERE site_id=? AND emoji=? AND day=?", urlId, emoji, rollup.Day)
+	if err != nil {
+		return err
+	}
+	err = tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM reaction WHERE site_id=? AND emoji=? AND DATE(created_at)=?", urlId, emoji, rollup.Day)
+	if err != nil {
+		return err
+	}
+
+	count := max(rolledUp+reactions, rollup.Count)
+	_, err = tx.ExecContext(ctx, "INSERT INTO reaction_rollup (site_id, emoji, day, count) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE count=?", urlId, emoji, rollup.Day, count, count)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM reaction WHERE site_id=? AND emoji=? AND DATE(created_at)=?", urlId, emoji, rollup.Day)
+	return err
+}
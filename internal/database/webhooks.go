@@ -0,0 +1,240 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+type Webhook struct {
+	Id        int    `db:"id" json:"id"`
+	Url       string `db:"url" json:"url"`
+	TargetUrl string `db:"target_url" json:"target"`
+	Secret    string `db:"secret" json:"secret,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id        int64  `db:"id"`
+	WebhookId int    `db:"webhook_id"`
+	TargetUrl string `db:"target_url"`
+	Secret    string `db:"secret"`
+	Payload   []byte `db:"payload"`
+	Attempts  int    `db:"attempts"`
+}
+
+const webhookColumns = "webhook.id, site.url, webhook.target_url, webhook.secret"
+
+func (db *DB) InsertWebhook(ctx context.Context, url string, targetUrl string, secret string) (_ Webhook, err error) {
+	ctx, span := startSpan(ctx, "InsertWebhook")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Webhook{}, err
+	}
+	defer tx.Rollback()
+
+	urlId, err := ensureSite(ctx, tx, url)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO webhook (site_id, target_url, secret) VALUES (?, ?, ?)", urlId, targetUrl, secret)
+	if err != nil {
+		return Webhook{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	var webhook Webhook
+	err = tx.GetContext(ctx, &webhook, "SELECT "+webhookColumns+" FROM webhook JOIN site ON site.id = webhook.site_id WHERE webhook.id=?", id)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, tx.Commit()
+}
+
+// Webhooks returns every webhook registered for a site
+func (db *DB) Webhooks(ctx context.Context, url string) (_ []Webhook, err error) {
+	ctx, span := startSpan(ctx, "Webhooks")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	webhooks := []Webhook{}
+	err = db.SelectContext(ctx, &webhooks, "SELECT "+webhookColumns+" FROM webhook JOIN site ON site.id = webhook.site_id WHERE site.url=? ORDER BY webhook.id", url)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook along with any deliveries still waiting in its outbox, and returns
+// what was deleted. If there is no such webhook, ErrNotFound is returned.
+func (db *DB) DeleteWebhook(ctx context.Context, id int) (_ Webhook, err error) {
+	ctx, span := startSpan(ctx, "DeleteWebhook")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Webhook{}, err
+	}
+	defer tx.Rollback()
+
+	var webhook Webhook
+	err = tx.GetContext(ctx, &webhook, "SELECT "+webhookColumns+" FROM webhook JOIN site ON site.id = webhook.site_id WHERE webhook.id=?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, ErrNotFound
+	}
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM webhook WHERE id=?", id)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, tx.Commit()
+}
+
+// HasWebhooks is a cheap check to avoid building a payload for a site nobody is listening to
+func (db *DB) HasWebhooks(ctx context.Context, url string) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "HasWebhooks")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var exists bool
+	err = db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM webhook JOIN site ON site.id = webhook.site_id WHERE site.url=?)", url)
+	return exists, err
+}
+
+// EnqueueWebhookDeliveries adds the payload to the outbox once for every webhook registered for a site
+func (db *DB) EnqueueWebhookDeliveries(ctx context.Context, url string, payload []byte) (err error) {
+	ctx, span := startSpan(ctx, "EnqueueWebhookDeliveries")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, `INSERT INTO webhook_outbox (webhook_id, payload)
+		SELECT webhook.id, ? FROM webhook JOIN site ON site.id = webhook.site_id WHERE site.url=?`, payload, url)
+	return err
+}
+
+// DueWebhookDeliveries returns deliveries that haven't succeeded or given up, and whose next attempt is due
+func (db *DB) DueWebhookDeliveries(ctx context.Context, limit int) (_ []WebhookDelivery, err error) {
+	ctx, span := startSpan(ctx, "DueWebhookDeliveries")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var deliveries []WebhookDelivery
+	err = db.SelectContext(ctx, &deliveries, `SELECT webhook_outbox.id, webhook_outbox.webhook_id, webhook.target_url, webhook.secret,
+			webhook_outbox.payload, webhook_outbox.attempts
+		FROM webhook_outbox JOIN webhook ON webhook.id = webhook_outbox.webhook_id
+		WHERE webhook_outbox.delivered_at IS NULL AND webhook_outbox.failed_at IS NULL AND webhook_outbox.next_attempt_at <= NOW()
+		ORDER BY webhook_outbox.next_attempt_at
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// ClaimWebhookDelivery records an attempt at a delivery, and leases it for as long as the attempt may take,
+// after which it's due again in case the attempt never reported back. It reports false if another worker
+// claimed the delivery first.
+func (db *DB) ClaimWebhookDelivery(ctx context.Context, delivery WebhookDelivery, lease time.Duration) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "ClaimWebhookDelivery")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// Times are left to the database, so they agree with the TIMESTAMP columns whatever the session time zone is
+	result, err := db.ExecContext(ctx, "UPDATE webhook_outbox SET attempts=attempts+1, next_attempt_at=DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id=? AND attempts=?",
+		int(lease.Seconds()), delivery.Id, delivery.Attempts)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func (db *DB) CompleteWebhookDelivery(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "CompleteWebhookDelivery")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, "UPDATE webhook_outbox SET delivered_at=NOW(), last_error=NULL WHERE id=?", id)
+	return err
+}
+
+// FailWebhookDelivery records why an attempt failed, and schedules the next one after retryAfter. A final
+// failure stops any further attempts.
+func (db *DB) FailWebhookDelivery(ctx context.Context, id int64, reason string, retryAfter time.Duration, final bool) (err error) {
+	ctx, span := startSpan(ctx, "FailWebhookDelivery")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	reason = truncate(reason, maxErrorLength)
+
+	if final {
+		_, err := db.ExecContext(ctx, "UPDATE webhook_outbox SET last_error=?, failed_at=NOW() WHERE id=?", reason, id)
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE webhook_outbox SET last_error=?, next_attempt_at=DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id=?",
+		reason, int(retryAfter.Seconds()), id)
+	return err
+}
+
+// The size of webhook_outbox.last_error
+const maxErrorLength = 1024
+
+// truncate cuts s down to at most n bytes, without splitting a rune
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// PendingWebhookDeliveries returns how many deliveries are waiting in the outbox, whether due yet or not
+func (db *DB) PendingWebhookDeliveries(ctx context.Context) (_ int, err error) {
+	ctx, span := startSpan(ctx, "PendingWebhookDeliveries")
+	defer endSpan(span, &err)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var pending int
+	err = db.GetContext(ctx, &pending, "SELECT COUNT(*) FROM webhook_outbox WHERE delivered_at IS NULL AND failed_at IS NULL")
+	return pending, err
+}
@@ -0,0 +1,25 @@
+package database
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"abcdef", 3, "abc"},
+		// 💖 is 4 bytes, so cutting into it drops all of it
+		{"ab💖", 3, "ab"},
+		{"ab💖", 5, "ab"},
+		{"ab💖c", 6, "ab💖"},
+		{"é", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The handoff works like socket activation, but under variables of its own, as the process handing off can't
+// know the pid systemd would have it set before starting the new one
+const (
+	handoffFdsEnv   = "OPENHEART_LISTEN_FDS"
+	handoffNamesEnv = "OPENHEART_LISTEN_FDNAMES"
+	readyFdEnv      = "OPENHEART_READY_FD"
+)
+
+// Handoff returns the listeners passed by the process this one replaces, see Restart. Without any, it returns
+// none.
+func Handoff() ([]Inherited, error) {
+	fds, names := os.Getenv(handoffFdsEnv), os.Getenv(handoffNamesEnv)
+	os.Unsetenv(handoffFdsEnv)
+	os.Unsetenv(handoffNamesEnv)
+
+	if fds == "" {
+		return nil, nil
+	}
+
+	return inherit(fds, names)
+}
+
+// Restart starts the executable this process was started as again, with the same arguments, passing it the
+// listeners. It returns once the new process has called Ready, and gives up on it if that takes longer than
+// timeout or it exits first.
+//
+// Both processes accept connections from the listeners until this one closes its own.
+func Restart(listeners []Inherited, timeout time.Duration) (*os.Process, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	names := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("can't pass on a %s listener", l.Listener.Addr().Network())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, l.Name)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		handoffFdsEnv+"="+strconv.Itoa(len(listeners)),
+		handoffNamesEnv+"="+strings.Join(names, ":"),
+		readyFdEnv+"="+strconv.Itoa(firstFd+len(listeners)),
+	)
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// Once this end of the pipe is closed, it only stays open for as long as the new process does
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	err = readyReader.SetReadDeadline(time.Now().Add(timeout))
+	if err == nil {
+		_, err = readyReader.Read(make([]byte, 1))
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process wasn't ready after %s", timeout)
+		}
+		return nil, errors.New("new process exited before it was ready")
+	}
+
+	// The sockets have to outlive these listeners now the new process has them, or closing them would remove
+	// them. Until then, they're still this process's to clean up.
+	for _, l := range listeners {
+		if unixListener, ok := l.Listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// Ready tells the process that started this one with Restart that it's ready to take over. Without one, it
+// does nothing.
+func Ready() error {
+	fd := os.Getenv(readyFdEnv)
+	os.Unsetenv(readyFdEnv)
+
+	if fd == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", readyFdEnv, fd)
+	}
+
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+
+	_, err = f.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+
+package listen
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const helperEnv = "OPENHEART_TEST_HANDOFF"
+
+// TestHandoffHelper stands in for the new process when Restart runs the test binary again
+func TestHandoffHelper(t *testing.T) {
+	if os.Getenv(helperEnv) == "" {
+		t.Skip("only run by TestRestart")
+	}
+	if err := Ready(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A unix socket is only left behind for the new process once it's ready, and removed as usual otherwise
+func TestRestart(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantErr   bool
+		wantExist bool
+	}{
+		{name: "ready", args: []string{os.Args[0], "-test.run=^TestHandoffHelper$"}, wantExist: true},
+		{name: "exits first", args: []string{"false"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "openheart.sock")
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := os.Args
+			os.Args = tt.args
+			t.Cleanup(func() { os.Args = args })
+			t.Setenv(helperEnv, "1")
+
+			process, err := Restart([]Inherited{{Name: "http", Listener: l}}, 10*time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restart = %v, want an error %t", err, tt.wantErr)
+			}
+			if process != nil {
+				process.Wait()
+			}
+
+			l.Close()
+			if _, err := os.Stat(path); (err == nil) != tt.wantExist {
+				t.Errorf("socket exists after close = %t, want %t", err == nil, tt.wantExist)
+			}
+		})
+	}
+}
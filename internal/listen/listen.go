@@ -0,0 +1,106 @@
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed to a child process, after stdin, stdout and stderr
+const firstFd = 3
+
+// Inherited is a listener passed down by the process that started this one, named after its socket unit's
+// FileDescriptorName, or by the process it replaces
+type Inherited struct {
+	Name     string
+	Listener net.Listener
+}
+
+// Systemd returns the listeners passed by systemd socket activation, in the order they were passed. Without
+// any, it returns none. The LISTEN_* variables are cleared, so they aren't passed on to child processes.
+func Systemd() ([]Inherited, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	return inherit(fds, names)
+}
+
+// inherit turns the file descriptors passed from 3 onwards into listeners, named by the colon separated names
+func inherit(fds string, names string) ([]Inherited, error) {
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid number of listeners %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	var inherited []Inherited
+	for i := range count {
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+
+		f := os.NewFile(uintptr(firstFd+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range inherited {
+				l.Listener.Close()
+			}
+			return nil, fmt.Errorf("inheriting listener %d: %w", i, err)
+		}
+
+		inherited = append(inherited, Inherited{Name: name, Listener: listener})
+	}
+
+	return inherited, nil
+}
+
+// Unix listens on a Unix domain socket, replacing the socket left behind by a process that didn't get to
+// clean up after itself. The socket is removed again when the listener is closed.
+func Unix(path string, mode fs.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode().Type() == fs.ModeSocket:
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	case err == nil:
+		return nil, fmt.Errorf("%s exists and isn't a socket", path)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
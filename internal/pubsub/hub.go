@@ -0,0 +1,203 @@
+package pubsub
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const subscriberBuffer = 16
+
+// A topic is kept for a while after its last subscriber leaves, so one reconnecting can still resume. The
+// oldest idle topics go first once there are too many.
+const (
+	idleTopicLimit = 10000
+	idleTopicTTL   = 5 * time.Minute
+)
+
+type Event struct {
+	Id    uint64
+	Topic string
+	Data  any
+}
+
+// Hub fans events out to subscribers of a topic. Event ids are unique and increasing across
+// every topic, so a subscriber can resume from the last id it saw.
+type Hub struct {
+	mu          sync.Mutex
+	historySize int
+	lastId      uint64
+	topics      map[string]*topic
+	idleTopics  *list.List // Names of the topics without subscribers, most recently idle at the front
+	closed      bool
+	done        chan struct{}
+}
+
+type topic struct {
+	subscribers map[*Subscription]struct{}
+	history     []Event
+	// The history is complete for any id at or after both of these
+	since   uint64
+	dropped uint64
+
+	idle      *list.Element // In idleTopics, while there are no subscribers
+	idleSince time.Time
+}
+
+type Subscription struct {
+	C     <-chan Event
+	c     chan Event
+	hub   *Hub
+	topic string
+	once  sync.Once
+}
+
+// New creates a hub that remembers the last historySize events of each topic for resuming subscribers.
+// Ids start from the current time, so an id handed out before a restart is never mistaken for a new one.
+func New(historySize int) *Hub {
+	return &Hub{
+		historySize: historySize,
+		lastId:      uint64(time.Now().UnixMicro()),
+		topics:      map[string]*topic{},
+		idleTopics:  list.New(),
+		done:        make(chan struct{}),
+	}
+}
+
+// Subscribe starts receiving events for a topic. Events after lastId that are still in the history are
+// returned as a backlog. The bool reports whether that backlog is complete, if not the subscriber
+// should fetch the current state instead.
+func (h *Hub) Subscribe(name string, lastId uint64) (*Subscription, []Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, hub: h, topic: name}
+	if h.closed {
+		close(c)
+		return s, nil, false
+	}
+
+	h.expireIdle()
+	t, exists := h.topics[name]
+	if !exists {
+		t = &topic{subscribers: map[*Subscription]struct{}{}, since: h.lastId}
+		h.topics[name] = t
+	}
+	if t.idle != nil {
+		h.idleTopics.Remove(t.idle)
+		t.idle = nil
+	}
+	t.subscribers[s] = struct{}{}
+
+	var backlog []Event
+	for _, event := range t.history {
+		if event.Id > lastId {
+			backlog = append(backlog, event)
+		}
+	}
+	complete := lastId >= t.since && lastId >= t.dropped && lastId <= h.lastId
+
+	return s, backlog, complete
+}
+
+// Publish sends an event to every subscriber of a topic. Subscribers that can't keep up are dropped
+// rather than blocking the publisher; they can reconnect and resume from their last event id.
+func (h *Hub) Publish(name string, data any) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastId++
+	event := Event{Id: h.lastId, Topic: name, Data: data}
+
+	// Nobody is listening, or has been lately, so there is nobody to resume either
+	h.expireIdle()
+	t, exists := h.topics[name]
+	if !exists || h.closed {
+		return event
+	}
+
+	t.history = append(t.history, event)
+	if len(t.history) > h.historySize {
+		t.dropped = t.history[0].Id
+		t.history = t.history[1:]
+	}
+
+	for s := range t.subscribers {
+		select {
+		case s.c <- event:
+		default:
+			h.unsubscribe(s)
+		}
+	}
+
+	return event
+}
+
+// LastId returns the id of the most recently published event.
+func (h *Hub) LastId() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.lastId
+}
+
+// Done returns a channel that's closed when the hub is closed.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Close ends every subscription. Publishing afterward is a no-op.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	for _, t := range h.topics {
+		for s := range t.subscribers {
+			h.unsubscribe(s)
+		}
+	}
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.unsubscribe(s)
+}
+
+// unsubscribe must be called with the hub's lock held
+func (h *Hub) unsubscribe(s *Subscription) {
+	s.once.Do(func() {
+		close(s.c)
+	})
+
+	t, exists := h.topics[s.topic]
+	if !exists {
+		return
+	}
+	delete(t.subscribers, s)
+	if len(t.subscribers) == 0 && t.idle == nil {
+		t.idle = h.idleTopics.PushFront(s.topic)
+		t.idleSince = time.Now()
+		h.expireIdle()
+	}
+}
+
+// expireIdle forgets the topics that have been idle for too long, or the oldest ones beyond the limit. It
+// must be called with the hub's lock held.
+func (h *Hub) expireIdle() {
+	for element := h.idleTopics.Back(); element != nil; element = h.idleTopics.Back() {
+		name := element.Value.(string)
+		if h.idleTopics.Len() <= idleTopicLimit && time.Since(h.topics[name].idleSince) < idleTopicTTL {
+			return
+		}
+		h.idleTopics.Remove(element)
+		delete(h.topics, name)
+	}
+}
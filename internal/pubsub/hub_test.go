@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestResumeAfterLastSubscriberLeaves(t *testing.T) {
+	h := New(10)
+
+	s, _, _ := h.Subscribe("example.com", 0)
+	seen := h.Publish("example.com", 1)
+	<-s.C
+	s.Close()
+
+	// Published while the only subscriber reconnects
+	missed := h.Publish("example.com", 2)
+
+	s, backlog, complete := h.Subscribe("example.com", seen.Id)
+	defer s.Close()
+	if !complete {
+		t.Error("the backlog isn't complete")
+	}
+	if len(backlog) != 1 || backlog[0].Id != missed.Id {
+		t.Errorf("backlog = %v, want the event published in between", backlog)
+	}
+}
+
+func TestNoHistoryWithoutSubscribers(t *testing.T) {
+	h := New(10)
+
+	h.Publish("example.com", 1)
+
+	s, backlog, _ := h.Subscribe("example.com", 0)
+	defer s.Close()
+	if len(backlog) != 0 {
+		t.Errorf("backlog = %v, want none for a topic nobody subscribed to", backlog)
+	}
+}
+
+func TestIdleTopicsAreLimited(t *testing.T) {
+	h := New(10)
+
+	for i := range idleTopicLimit + 1 {
+		s, _, _ := h.Subscribe(strconv.Itoa(i), 0)
+		s.Close()
+	}
+
+	if len(h.topics) != idleTopicLimit || h.idleTopics.Len() != idleTopicLimit {
+		t.Errorf("%d topics and %d idle, want %d of both", len(h.topics), h.idleTopics.Len(), idleTopicLimit)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	h := New(10)
+
+	s, _, _ := h.Subscribe("example.com", 0)
+	for i := range subscriberBuffer + 1 {
+		h.Publish("example.com", i)
+	}
+
+	received := 0
+	for range s.C {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", received, subscriberBuffer)
+	}
+}
@@ -0,0 +1,64 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+var (
+	ErrInvalidEmoji = errors.New("no emoji found")
+	ErrBadJSON      = errors.New("body contains badly-formed JSON")
+)
+
+// ParseEmoji extracts the first grapheme of a reaction body and checks it is an emoji.
+// The body is interpreted based on the Content-Type it was sent with.
+func ParseEmoji(contentType string, body []byte) (EmojiT, error) {
+	var emoji EmojiT
+	var value []byte
+
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(mediaType) {
+
+	// Form submissions are url encoded, so we need to decode them before getting the
+	// key rune
+	case "application/x-www-form-urlencoded":
+		escapedValue, err := url.QueryUnescape(string(body))
+		if err != nil {
+			return emoji, ErrInvalidEmoji
+		}
+		value, _, _, _ = uniseg.Step([]byte(escapedValue), -1)
+
+	// JSON has a specific structure {"emoji": "🌾"}
+	// So, we need to convert it to this structure first. Then we parse it
+	case "application/json":
+		var jInput = struct {
+			Emoji string `json:"emoji"`
+		}{}
+		err := json.Unmarshal(body, &jInput)
+		if err != nil {
+			return emoji, ErrBadJSON
+		}
+		value, _, _, _ = uniseg.Step([]byte(jInput.Emoji), -1)
+
+	//	For all other requests, we try to decode the string and get the first rune.
+	default:
+		value, _, _, _ = uniseg.Step(body, -1)
+	}
+
+	if len(value) == 0 {
+		return emoji, ErrInvalidEmoji
+	}
+	emoji.Bytes = value
+
+	// Let's see if the first rune is an emoji
+	emojiRunes, err := emoji.ParseRunes()
+	if err != nil || emojiRunes[0] == 0 {
+		return emoji, ErrInvalidEmoji
+	}
+
+	return emoji, nil
+}
@@ -0,0 +1,71 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WeakETag hashes the JSON encoding of data. Maps encode with sorted keys, so equal data always results in
+// the same tag. It's weak as it identifies the data rather than the bytes of a response, so data served in
+// several formats needs the format hashed along with it.
+func WeakETag(data any) (string, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(js)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
+
+// NotModified sets the validators for a response and checks them against the request's conditional headers.
+// If the client's copy is still fresh, a 304 is written and true is returned. Either validator can be left
+// empty.
+//
+// If-None-Match takes precedence, If-Modified-Since is only considered without it.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	var fresh bool
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		fresh = etag != "" && etagMatches(ifNoneMatch, etag)
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		fresh = err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	if !fresh {
+		return false
+	}
+
+	// A 304 has no body, so the headers describing one don't belong
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches uses the weak comparison, which is the one If-None-Match calls for
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
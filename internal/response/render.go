@@ -0,0 +1,355 @@
+package response
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrNotAcceptable = errors.New("no acceptable representation")
+
+// A Renderer writes data in one media type. Formats that only make sense for tabular data report
+// which data they can render, so negotiation can skip them.
+type Renderer interface {
+	ContentType() string
+	CanRender(data any) bool
+	Render(w io.Writer, data any) error
+}
+
+// Table is data that renders as rows, as plain text, CSV and HTML do
+type Table interface {
+	Columns() []string
+	Rows() [][]string
+}
+
+// Wrapper is data that wraps other data, like an envelope. Tabular formats render what's inside.
+type Wrapper interface {
+	Unwrap() any
+}
+
+// Registry picks a renderer based on the request's Accept header
+type Registry struct {
+	mediaTypes []string
+	renderers  map[string]Renderer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{renderers: map[string]Renderer{}}
+}
+
+// Register adds a renderer for a media type. When a client accepts several media types equally, the one
+// registered first wins.
+func (reg *Registry) Register(mediaType string, renderer Renderer) {
+	if _, exists := reg.renderers[mediaType]; !exists {
+		reg.mediaTypes = append(reg.mediaTypes, mediaType)
+	}
+	reg.renderers[mediaType] = renderer
+}
+
+// Default renders JSON unless the client asks for something else
+var Default = func() *Registry {
+	reg := NewRegistry()
+	reg.Register("application/json", jsonRenderer{})
+	reg.Register("text/plain", textRenderer{})
+	reg.Register("text/csv", csvRenderer{})
+	reg.Register("text/html", htmlRenderer{})
+	reg.Register("application/msgpack", msgpackRenderer{contentType: "application/msgpack"})
+	reg.Register("application/x-msgpack", msgpackRenderer{contentType: "application/x-msgpack"})
+	return reg
+}()
+
+// Negotiate returns the renderer the client prefers for data. If the client accepts none of the formats
+// that can render data, ErrNotAcceptable is returned.
+func (reg *Registry) Negotiate(accept string, data any) (Renderer, error) {
+	ranges := parseAccept(accept)
+
+	var best Renderer
+	var bestQ float64
+	for _, mediaType := range reg.mediaTypes {
+		renderer := reg.renderers[mediaType]
+		if !renderer.CanRender(data) {
+			continue
+		}
+
+		q := quality(ranges, mediaType)
+		if q > bestQ {
+			best, bestQ = renderer, q
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNotAcceptable
+	}
+	return best, nil
+}
+
+// NegotiateOrDefault is Negotiate, but rather than failing when the client accepts none of the formats that
+// can render data, it falls back to the first one registered that can, JSON for Default
+func (reg *Registry) NegotiateOrDefault(accept string, data any) Renderer {
+	renderer, err := reg.Negotiate(accept, data)
+	if err == nil {
+		return renderer
+	}
+
+	for _, mediaType := range reg.mediaTypes {
+		if reg.renderers[mediaType].CanRender(data) {
+			return reg.renderers[mediaType]
+		}
+	}
+	return nil
+}
+
+// Render negotiates a format for data and writes it. Nothing is written if the result is ErrNotAcceptable,
+// so the caller can still respond with an error.
+func (reg *Registry) Render(w http.ResponseWriter, r *http.Request, status int, data any, headers http.Header) error {
+	AddVary(w.Header(), "Accept")
+
+	renderer, err := reg.Negotiate(r.Header.Get("Accept"), data)
+	if err != nil {
+		return err
+	}
+
+	return reg.RenderWith(w, renderer, status, data, headers)
+}
+
+// RenderWith writes data in the format of a renderer that was already negotiated
+func (reg *Registry) RenderWith(w http.ResponseWriter, renderer Renderer, status int, data any, headers http.Header) error {
+	AddVary(w.Header(), "Accept")
+
+	var buf bytes.Buffer
+	err := renderer.Render(&buf, data)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", renderer.ContentType())
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+// AddVary lists a request header the response varies by, unless it already is
+func AddVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	if strings.TrimSpace(accept) == "" {
+		return []acceptRange{{mediaType: "*/*", q: 1}}
+	}
+
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, exists := params["q"]; exists {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// quality returns the q value of the most specific range matching the media type
+func quality(ranges []acceptRange, mediaType string) float64 {
+	kind, _, _ := strings.Cut(mediaType, "/")
+
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		var s int
+		switch r.mediaType {
+		case mediaType:
+			s = 2
+		case kind + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+func asTable(data any) (Table, bool) {
+	if wrapper, ok := data.(Wrapper); ok {
+		data = wrapper.Unwrap()
+	}
+	table, ok := data.(Table)
+	return table, ok
+}
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) ContentType() string { return "application/json" }
+
+func (jsonRenderer) CanRender(any) bool { return true }
+
+func (jsonRenderer) Render(w io.Writer, data any) error {
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(js, '\n'))
+	return err
+}
+
+// msgpack uses the json tags, so field names match the JSON representation
+type msgpackRenderer struct {
+	contentType string
+}
+
+func (m msgpackRenderer) ContentType() string { return m.contentType }
+
+func (msgpackRenderer) CanRender(any) bool { return true }
+
+func (msgpackRenderer) Render(w io.Writer, data any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	return enc.Encode(data)
+}
+
+// text renders one row per line, with the values separated by spaces, e.g. "💖 5"
+type textRenderer struct{}
+
+func (textRenderer) ContentType() string { return "text/plain; charset=utf-8" }
+
+func (textRenderer) CanRender(data any) bool {
+	_, ok := asTable(data)
+	return ok
+}
+
+func (textRenderer) Render(w io.Writer, data any) error {
+	table, _ := asTable(data)
+	for _, row := range table.Rows() {
+		_, err := fmt.Fprintln(w, strings.Join(row, " "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type csvRenderer struct{}
+
+func (csvRenderer) ContentType() string { return "text/csv; charset=utf-8" }
+
+func (csvRenderer) CanRender(data any) bool {
+	_, ok := asTable(data)
+	return ok
+}
+
+func (csvRenderer) Render(w io.Writer, data any) error {
+	table, _ := asTable(data)
+
+	cw := csv.NewWriter(w)
+	err := cw.Write(table.Columns())
+	if err != nil {
+		return err
+	}
+	err = cw.WriteAll(table.Rows())
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// html renders a fragment rather than a document, to be included in a page, htmx style
+type htmlRenderer struct{}
+
+func (htmlRenderer) ContentType() string { return "text/html; charset=utf-8" }
+
+func (htmlRenderer) CanRender(data any) bool {
+	_, ok := asTable(data)
+	return ok
+}
+
+func (htmlRenderer) Render(w io.Writer, data any) error {
+	table, _ := asTable(data)
+	columns := table.Columns()
+
+	var b strings.Builder
+	b.WriteString("<table class=\"open-heart\">\n<thead><tr>")
+	for _, column := range columns {
+		fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(column))
+	}
+	b.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range table.Rows() {
+		b.WriteString("<tr>")
+		for i, value := range row {
+			fmt.Fprintf(&b, "<td class=\"%s\">%s</td>", html.EscapeString(columns[i]), html.EscapeString(value))
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Counts are reaction counts keyed by emoji. They render as an object in JSON and msgpack, and as one row
+// per emoji, highest count first, everywhere else.
+type Counts map[string]int
+
+func (c Counts) Columns() []string {
+	return []string{"emoji", "count"}
+}
+
+func (c Counts) Rows() [][]string {
+	emoji := make([]string, 0, len(c))
+	for e := range c {
+		emoji = append(emoji, e)
+	}
+	sort.Slice(emoji, func(i, j int) bool {
+		if c[emoji[i]] != c[emoji[j]] {
+			return c[emoji[i]] > c[emoji[j]]
+		}
+		return emoji[i] < emoji[j]
+	})
+
+	rows := make([][]string, len(emoji))
+	for i, e := range emoji {
+		rows[i] = []string{e, strconv.Itoa(c[e])}
+	}
+	return rows
+}
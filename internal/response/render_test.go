@@ -0,0 +1,92 @@
+package response
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   []acceptRange
+	}{
+		{"", []acceptRange{{"*/*", 1}}},
+		{"  ", []acceptRange{{"*/*", 1}}},
+		{"text/csv", []acceptRange{{"text/csv", 1}}},
+		{"text/csv;q=0.5, text/plain", []acceptRange{{"text/csv", 0.5}, {"text/plain", 1}}},
+		{"TEXT/CSV; charset=utf-8; q=0.3", []acceptRange{{"text/csv", 0.3}}},
+		{"text/*;q=0, */*;q=0.1", []acceptRange{{"text/*", 0}, {"*/*", 0.1}}},
+		// Ranges that don't parse are left out, rather than spoiling the rest
+		{"text/csv;q=high, text/plain, ;;", []acceptRange{{"text/plain", 1}}},
+	}
+	for _, tt := range tests {
+		got := parseAccept(tt.accept)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAccept(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+type notTable struct{}
+
+func TestNegotiate(t *testing.T) {
+	counts := Counts{"💖": 1}
+
+	tests := []struct {
+		name   string
+		accept string
+		data   any
+		want   string
+	}{
+		{"no accept", "", counts, "application/json"},
+		{"exact", "text/csv", counts, "text/csv; charset=utf-8"},
+		{"highest q", "text/plain;q=0.5, text/html;q=0.9", counts, "text/html; charset=utf-8"},
+		{"any", "*/*", counts, "application/json"},
+		{"type wildcard ties go to the first registered", "text/*", counts, "text/plain; charset=utf-8"},
+		{"equal q goes to the first registered", "application/msgpack, text/csv", counts, "text/csv; charset=utf-8"},
+		{"most specific range decides", "text/*;q=0.2, text/csv;q=0.8, */*;q=0.1", counts, "text/csv; charset=utf-8"},
+		{"q=0 rules a type out", "text/plain;q=0, text/*", counts, "text/csv; charset=utf-8"},
+		{"q=0 rules a wildcard out", "*/*;q=0, application/x-msgpack", counts, "application/x-msgpack"},
+		{"tabular formats skip other data", "text/csv, application/json;q=0.1", notTable{}, "application/json"},
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", counts, "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renderer, err := Default.Negotiate(tt.accept, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := renderer.ContentType(); got != tt.want {
+				t.Errorf("Negotiate(%q) = %s, want %s", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateNotAcceptable(t *testing.T) {
+	for _, accept := range []string{"image/png", "*/*;q=0", "text/csv", "application/json;q=0, text/*"} {
+		_, err := Default.Negotiate(accept, notTable{})
+		if !errors.Is(err, ErrNotAcceptable) {
+			t.Errorf("Negotiate(%q) = %v, want ErrNotAcceptable", accept, err)
+		}
+
+		if got := Default.NegotiateOrDefault(accept, notTable{}).ContentType(); got != "application/json" {
+			t.Errorf("NegotiateOrDefault(%q) = %s, want application/json", accept, got)
+		}
+	}
+}
+
+func TestRenderVary(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Vary", "Origin, accept")
+
+	err := Default.Render(w, httptest.NewRequest("GET", "/", nil), 200, Counts{"💖": 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Values("Vary"); !reflect.DeepEqual(got, []string{"Origin, accept"}) {
+		t.Errorf("Vary = %q, want Accept listed once", got)
+	}
+}
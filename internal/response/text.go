@@ -0,0 +1,21 @@
+package response
+
+import (
+	"net/http"
+)
+
+func Text(w http.ResponseWriter, status int, body string) error {
+	return TextWithHeaders(w, status, body, nil)
+}
+
+func TextWithHeaders(w http.ResponseWriter, status int, body string, headers http.Header) error {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(body))
+
+	return err
+}
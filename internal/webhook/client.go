@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned for a target that resolves to an address of the server's own network
+var ErrForbiddenAddress = errors.New("webhook targets on loopback, link-local and private addresses are not allowed")
+
+// NewClient returns the client deliveries are sent with. Unless allowPrivate, it refuses to connect to
+// loopback, link-local, private and unspecified addresses, so a webhook can't be pointed at the server's own
+// network. The check is made on the address actually dialled, after DNS, so names resolving to such an
+// address, and redirects to one, are refused too.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Through a proxy, the proxy's address would be checked rather than the target's
+	transport.Proxy = nil
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func refusePrivate(network string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+	}
+	return nil
+}
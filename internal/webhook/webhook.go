@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-OpenHeart-Signature"
+	EventHeader     = "X-OpenHeart-Event"
+	DeliveryHeader  = "X-OpenHeart-Delivery"
+)
+
+// NewSecret returns a random secret for signing deliveries
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header for a body. The timestamp is part of the signed content, so a receiver
+// can reject old deliveries being replayed.
+//
+//	t=1700000000,v1=<hex encoded HMAC-SHA256 of "1700000000.<body>">
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, computeSignature(secret, t, body))
+}
+
+// Verify checks a signature header produced by Sign, and that it is no older than tolerance
+func Verify(secret string, header string, body []byte, tolerance time.Duration) bool {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > tolerance {
+		return false
+	}
+
+	return hmac.Equal([]byte(v1), []byte(computeSignature(secret, t, body)))
+}
+
+func computeSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver POSTs a signed JSON payload to a target. Any response outside of 2xx is an error.
+func Deliver(ctx context.Context, client *http.Client, target string, secret string, event string, deliveryId string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "openheart-protocol-webhook")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryId)
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook target responded %s", res.Status)
+	}
+
+	return nil
+}
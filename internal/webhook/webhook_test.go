@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"event":"reactions"}`)
+	header := Sign("secret", time.Now(), body)
+
+	if !Verify("secret", header, body, time.Minute) {
+		t.Error("a signature didn't verify")
+	}
+	if Verify("other secret", header, body, time.Minute) {
+		t.Error("a signature verified with another secret")
+	}
+	if Verify("secret", header, []byte(`{"event":"tampered"}`), time.Minute) {
+		t.Error("a signature verified for another body")
+	}
+	if Verify("secret", Sign("secret", time.Now().Add(-time.Hour), body), body, time.Minute) {
+		t.Error("an old signature verified")
+	}
+	if Verify("secret", "v1=abc", body, time.Minute) {
+		t.Error("a signature without a time verified")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	payload := []byte(`{"event":"reactions","url":"example.com"}`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method != http.MethodPost || r.Header.Get(EventHeader) != "reactions" || r.Header.Get(DeliveryHeader) != "42":
+			w.WriteHeader(http.StatusBadRequest)
+		case !Verify("secret", r.Header.Get(SignatureHeader), body, time.Minute):
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/failing":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	client := NewClient(time.Second, true)
+
+	err := Deliver(context.Background(), client, srv.URL, "secret", "reactions", "42", payload)
+	if err != nil {
+		t.Errorf("Deliver = %v, want it delivered", err)
+	}
+
+	err = Deliver(context.Background(), client, srv.URL, "other secret", "reactions", "42", payload)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Deliver = %v with the wrong secret, want the 401", err)
+	}
+
+	err = Deliver(context.Background(), client, srv.URL+"/failing", "secret", "reactions", "42", payload)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Deliver = %v to a failing target, want the 500", err)
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	err := Deliver(context.Background(), NewClient(time.Second, false), srv.URL, "secret", "reactions", "1", nil)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Deliver = %v to loopback, want ErrForbiddenAddress", err)
+	}
+
+	err = Deliver(context.Background(), NewClient(time.Second, true), srv.URL, "secret", "reactions", "1", nil)
+	if err != nil {
+		t.Errorf("Deliver = %v to loopback when it's allowed, want it delivered", err)
+	}
+}
+
+func TestRefusePrivate(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"::ffff:10.0.0.1": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"93.184.215.14":   true,
+		"2606:4700::1111": true,
+	}
+	for addr, allowed := range tests {
+		err := refusePrivate("tcp", net.JoinHostPort(addr, "443"), nil)
+		if (err == nil) != allowed {
+			t.Errorf("refusePrivate(%s) = %v, want allowed %t", addr, err, allowed)
+		}
+	}
+}